@@ -0,0 +1,170 @@
+package cloudypg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// Aggregate functions
+const (
+	AggregateCount         = "count"
+	AggregateCountDistinct = "countdistinct"
+	AggregateSum           = "sum"
+	AggregateAvg           = "avg"
+	AggregateMin           = "min"
+	AggregateMax           = "max"
+)
+
+// Aggregate is a value computed over each group. Count without a field counts
+// the documents, with a field it counts the documents where the field is set.
+// Sum, avg, min and max treat the field as a number and return a float.
+type Aggregate struct {
+	// Name of the result column, used to sort and filter on the value
+	Name  string
+	Func  string
+	Field string
+}
+
+// Aggregation groups the documents matching a query by the values of the
+// GroupBy fields and computes the aggregates for each group. Without GroupBy a
+// single row covers every matching document.
+//
+// Having filters the groups, with conditions on an aggregate name or a GroupBy
+// field in place of a document field. The sort of the query orders the groups
+// the same way and its size and offset page through them.
+type Aggregation struct {
+	GroupBy    []string
+	Aggregates []Aggregate
+	Having     *datastore.SimpleQueryConditionGroup
+}
+
+// aggregateExpr returns the SQL for the aggregate
+func (qc *PgQueryConverter) aggregateExpr(a Aggregate) string {
+	if a.Name == "" {
+		return qc.fail("%v aggregate needs a name", a.Func)
+	}
+	switch a.Func {
+	case AggregateCount:
+		if a.Field == "" {
+			return "count(*)"
+		}
+		return fmt.Sprintf("count(%v)", qc.toField(a.Field))
+	case AggregateCountDistinct:
+		if a.Field == "" {
+			return qc.fail("%v aggregate needs a field", a.Name)
+		}
+		return fmt.Sprintf("count(DISTINCT %v)", qc.toField(a.Field))
+	case AggregateSum, AggregateAvg, AggregateMin, AggregateMax:
+		if a.Field == "" {
+			return qc.fail("%v aggregate needs a field", a.Name)
+		}
+		return fmt.Sprintf("%v((%v)::numeric)::float8", a.Func, qc.toField(a.Field))
+	}
+	return qc.fail("unknown aggregate function %q for %v", a.Func, a.Name)
+}
+
+// ConvertAggregateWithArgs converts the query and aggregation into a SELECT of
+// the group by fields followed by the aggregates, each named after the field
+// or aggregate. A recursive query is aggregated over the whole hierarchy.
+func (qc *PgQueryConverter) ConvertAggregateWithArgs(q *datastore.SimpleQuery, table string, agg *Aggregation) (string, []any) {
+	from, where := table, ""
+	if q.RecurseConfig != nil {
+		// The sort and paging apply to the groups, not the hierarchy
+		inner := *q
+		inner.Colums, inner.SortBy, inner.Size, inner.Offset = nil, nil, 0, 0
+		sql, _ := qc.ConvertWithArgs(&inner, table)
+		from = fmt.Sprintf("(%v) AS hierarchy", sql)
+	} else {
+		qc.reset()
+		where = qc.convertWhere(q.Conditions)
+	}
+
+	// From here on the aggregate names resolve to their expressions
+	qc.fields = make(map[string]string, len(agg.Aggregates))
+	defer func() { qc.fields = nil }()
+
+	var columns, groups []string
+	for _, f := range agg.GroupBy {
+		expr := qc.toField(f)
+		columns = append(columns, fmt.Sprintf("%v AS %v", expr, QuoteIdentifier(f)))
+		groups = append(groups, expr)
+	}
+	for _, a := range agg.Aggregates {
+		expr := qc.aggregateExpr(a)
+		columns = append(columns, fmt.Sprintf("%v AS %v", expr, QuoteIdentifier(a.Name)))
+		qc.fields[a.Name] = expr
+	}
+	if len(columns) == 0 {
+		qc.fail("an aggregation needs a group by field or an aggregate")
+	}
+
+	sql := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), from)
+	if where != "" {
+		sql += " WHERE " + where
+	}
+	if len(groups) > 0 {
+		sql += " GROUP BY " + strings.Join(groups, ", ")
+	}
+	if agg.Having != nil {
+		if having := qc.ConvertConditionGroup(agg.Having); having != "" {
+			sql += " HAVING " + having
+		}
+	}
+	if sort := qc.ConvertSort(q.SortBy); sort != "" {
+		sql += " ORDER BY " + sort
+	}
+	if q.Size > 0 {
+		sql += fmt.Sprintf(" LIMIT %v", q.Size)
+	}
+	if q.Offset > 0 {
+		sql += fmt.Sprintf(" OFFSET %v", q.Offset)
+	}
+	return sql, qc.args
+}
+
+// Aggregate runs the aggregation over the documents matching the query and
+// returns a map for each group, keyed by the group by fields and aggregate
+// names. Use AggregateAs to scan the groups into a struct.
+func (ds *JsonDataStore[T]) Aggregate(ctx context.Context, query *datastore.SimpleQuery, agg *Aggregation) ([]map[string]any, error) {
+	return aggregateRows(ctx, ds, query, agg, pgx.RowToMap)
+}
+
+// AggregateAs is Aggregate with each group scanned into an R. The columns are
+// matched to the fields of R by name or db tag, so a group by field with a dot
+// needs a tag such as `db:"address.city"`. Counts scan into an int64 and the
+// other aggregates into a float64, with pointers for groups without a value.
+func AggregateAs[R any, T any](ctx context.Context, ds *JsonDataStore[T], query *datastore.SimpleQuery, agg *Aggregation) ([]*R, error) {
+	return aggregateRows(ctx, ds, query, agg, pgx.RowToAddrOfStructByName[R])
+}
+
+func aggregateRows[T any, R any](ctx context.Context, ds *JsonDataStore[T], query *datastore.SimpleQuery, agg *Aggregation, scan pgx.RowToFunc[R]) ([]R, error) {
+	if query == nil {
+		query = datastore.NewQuery()
+	}
+
+	qc := ds.converter()
+	sql, args := qc.ConvertAggregateWithArgs(query, ds.table, agg)
+	if err := qc.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, ds.wrapErr("aggregate", "", err)
+	}
+	rtn, err := pgx.CollectRows(rows, scan)
+	if err != nil {
+		return nil, ds.wrapErr("aggregate", "", err)
+	}
+	return rtn, nil
+}
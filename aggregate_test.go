@@ -0,0 +1,122 @@
+package cloudypg
+
+import (
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+type Order struct {
+	ID       string   `json:"id"`
+	Customer string   `json:"customer"`
+	Status   string   `json:"status"`
+	Amount   float64  `json:"amount"`
+	Tags     []string `json:"tags"`
+}
+
+func TestConvertAggregateWithArgs(t *testing.T) {
+	q := datastore.NewQuery()
+	q.Conditions.Equals("status", "paid")
+	q.SortBy = []*datastore.SortBy{{Field: "total", Descending: true}}
+	q.Size = 5
+
+	having := &datastore.SimpleQueryConditionGroup{Operator: "and"}
+	having.GreaterThan("orders", "1")
+
+	qc := &PgQueryConverter{filter: notDeletedCondition}
+	sql, args := qc.ConvertAggregateWithArgs(q, "orders", &Aggregation{
+		GroupBy: []string{"customer"},
+		Aggregates: []Aggregate{
+			{Name: "orders", Func: AggregateCount},
+			{Name: "total", Func: AggregateSum, Field: "amount"},
+		},
+		Having: having,
+	})
+	require.NoError(t, qc.Err())
+	require.Equal(t, `SELECT data->>'customer' AS "customer", count(*) AS "orders", sum((data->>'amount')::numeric)::float8 AS "total" FROM orders`+
+		` WHERE ( (data->>'status') = $1 ) AND deleted_at IS NULL GROUP BY data->>'customer'`+
+		` HAVING (count(*))::numeric  > $2 ORDER BY sum((data->>'amount')::numeric)::float8 DESC LIMIT 5`, sql)
+	require.Equal(t, []any{"paid", "1"}, args)
+
+	qc.ConvertAggregateWithArgs(datastore.NewQuery(), "orders", &Aggregation{
+		Aggregates: []Aggregate{{Name: "median", Func: "median", Field: "amount"}},
+	})
+	require.ErrorIs(t, qc.Err(), ErrInvalidQuery)
+
+	qc.ConvertAggregateWithArgs(datastore.NewQuery(), "orders", &Aggregation{})
+	require.ErrorIs(t, qc.Err(), ErrInvalidQuery)
+}
+
+func TestJsonDatastoreAggregate(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[Order](ctx, p, "orders")
+	require.NoError(t, ds.Open(ctx, nil))
+
+	for _, o := range []*Order{
+		{ID: "1", Customer: "acme", Status: "paid", Amount: 10},
+		{ID: "2", Customer: "acme", Status: "paid", Amount: 30},
+		{ID: "3", Customer: "globex", Status: "paid", Amount: 5},
+		{ID: "4", Customer: "globex", Status: "open", Amount: 100},
+		{ID: "5", Customer: "initech", Status: "paid", Amount: 1},
+	} {
+		require.NoError(t, ds.Save(ctx, o, o.ID))
+	}
+
+	q := datastore.NewQuery()
+	q.Conditions.Equals("status", "paid")
+	q.SortBy = []*datastore.SortBy{{Field: "total", Descending: true}}
+
+	agg := &Aggregation{
+		GroupBy: []string{"customer"},
+		Aggregates: []Aggregate{
+			{Name: "orders", Func: AggregateCount},
+			{Name: "total", Func: AggregateSum, Field: "amount"},
+			{Name: "average", Func: AggregateAvg, Field: "amount"},
+			{Name: "largest", Func: AggregateMax, Field: "amount"},
+		},
+	}
+
+	t.Run("Typed", func(t *testing.T) {
+		type customerTotals struct {
+			Customer string
+			Orders   int64
+			Total    float64
+			Average  float64
+			Largest  float64
+		}
+		rows, err := AggregateAs[customerTotals](ctx, ds, q, agg)
+		require.NoError(t, err)
+		require.Equal(t, []*customerTotals{
+			{Customer: "acme", Orders: 2, Total: 40, Average: 20, Largest: 30},
+			{Customer: "globex", Orders: 1, Total: 5, Average: 5, Largest: 5},
+			{Customer: "initech", Orders: 1, Total: 1, Average: 1, Largest: 1},
+		}, rows)
+	})
+
+	t.Run("Having", func(t *testing.T) {
+		having := &datastore.SimpleQueryConditionGroup{Operator: "and"}
+		having.GreaterThanOrEqual("total", "5")
+		rows, err := ds.Aggregate(ctx, q, &Aggregation{
+			GroupBy:    agg.GroupBy,
+			Aggregates: agg.Aggregates,
+			Having:     having,
+		})
+		require.NoError(t, err)
+		require.Len(t, rows, 2)
+		require.Equal(t, "acme", rows[0]["customer"])
+		require.Equal(t, int64(2), rows[0]["orders"])
+	})
+
+	t.Run("Count", func(t *testing.T) {
+		cnt, err := ds.Count(ctx, q)
+		require.NoError(t, err)
+		require.Equal(t, 4, cnt)
+	})
+}
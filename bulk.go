@@ -0,0 +1,101 @@
+package cloudypg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultBulkThreshold is the number of items from which SaveAll switches to
+// BulkSave when no threshold is given with WithBulkThreshold
+const DefaultBulkThreshold = 1000
+
+const bulkStagingTable = "cloudypg_bulk_staging"
+
+// BulkSaveResult counts the documents written by BulkSave
+type BulkSaveResult struct {
+	Inserted int64
+	Updated  int64
+}
+
+// WithBulkThreshold sets the number of items from which SaveAll uses BulkSave.
+// A threshold of 0 or less turns the bulk path off.
+func WithBulkThreshold(threshold int) JsonDataStoreOption {
+	return func(opts *jsonDataStoreOptions) {
+		opts.bulkThreshold = threshold
+	}
+}
+
+// useBulk reports if SaveAll should use BulkSave for this many items
+func (ds *JsonDataStore[T]) useBulk(n int) bool {
+	return ds.opts.bulkThreshold > 0 && n >= ds.opts.bulkThreshold
+}
+
+// BulkSave stores many items at once. The documents are streamed with the COPY
+// protocol into a temporary staging table and merged into the table with a
+// single upsert, so existing documents get their version and last updated time
+// bumped as they would by Save. When a key is given more than once the last
+// item wins. Everything runs in one transaction and the number of inserted and
+// updated documents is returned.
+func (ds *JsonDataStore[T]) BulkSave(ctx context.Context, items []*T, keys []string) (*BulkSaveResult, error) {
+	if len(items) != len(keys) {
+		return nil, errors.New("items and keys must be the same length")
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	dataType := "json"
+	if ds.jsonb.Load() {
+		dataType = "jsonb"
+	}
+
+	sqlMerge := fmt.Sprintf(`WITH upserted AS (
+			INSERT INTO %v AS t (id, data)
+			SELECT DISTINCT ON (id) id, data FROM %v ORDER BY id, ord DESC
+			ON CONFLICT (id) DO UPDATE
+			SET version = t.version + 1, last_updated = CURRENT_TIMESTAMP, data = EXCLUDED.data%v
+			RETURNING (xmax = 0) AS inserted
+		)
+		SELECT COUNT(*) FILTER (WHERE inserted), COUNT(*) FILTER (WHERE NOT inserted) FROM upserted`,
+		ds.table, bulkStagingTable, ds.reviveSet())
+
+	result := &BulkSaveResult{}
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, fmt.Sprintf(`CREATE TEMP TABLE %v (ord integer, id varchar(200), data %v) ON COMMIT DROP`,
+			bulkStagingTable, dataType))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{bulkStagingTable}, []string{"ord", "id", "data"},
+			pgx.CopyFromSlice(len(items), func(i int) ([]any, error) {
+				data, err := toByte(items[i])
+				if err != nil {
+					return nil, fmt.Errorf("error converting to json, %v", err)
+				}
+				return []any{i, keys[i], data}, nil
+			}))
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRow(ctx, sqlMerge).Scan(&result.Inserted, &result.Updated)
+		if err != nil {
+			return err
+		}
+
+		// Dropped now so another bulk save in the same transaction can create it
+		_, err = tx.Exec(ctx, "DROP TABLE "+bulkStagingTable)
+		return err
+	})
+	if err != nil {
+		return nil, ds.wrapErr("bulk save", "", err)
+	}
+	return result, nil
+}
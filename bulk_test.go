@@ -0,0 +1,65 @@
+package cloudypg
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJsonDatastoreBulkSave(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems", WithBulkThreshold(5))
+	require.NoError(t, ds.Open(ctx, nil))
+
+	require.NoError(t, ds.Save(ctx, &TestItem{ID: "item-0", Name: "existing"}, "item-0"))
+
+	items := make([]*TestItem, 10)
+	keys := make([]string, 10)
+	for i := range items {
+		items[i] = &TestItem{ID: fmt.Sprintf("item-%v", i), Name: "bulk"}
+		keys[i] = items[i].ID
+	}
+
+	result, err := ds.BulkSave(ctx, items, keys)
+	require.NoError(t, err)
+	require.Equal(t, &BulkSaveResult{Inserted: 9, Updated: 1}, result)
+
+	meta, err := ds.GetMetadata(ctx, "item-0", "item-1")
+	require.NoError(t, err)
+	for _, m := range meta {
+		if m.Key == "item-0" {
+			require.Equal(t, int64(2), m.Version)
+		} else {
+			require.Equal(t, int64(1), m.Version)
+		}
+	}
+
+	t.Run("Duplicate Keys", func(t *testing.T) {
+		dups := []*TestItem{{ID: "dup", Name: "first"}, {ID: "dup", Name: "last"}}
+		result, err := ds.BulkSave(ctx, dups, []string{"dup", "dup"})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), result.Inserted)
+
+		stored, err := ds.Get(ctx, "dup")
+		require.NoError(t, err)
+		require.Equal(t, "last", stored.Name)
+	})
+
+	t.Run("SaveAll Threshold", func(t *testing.T) {
+		for _, item := range items {
+			item.Name = "again"
+		}
+		require.NoError(t, ds.SaveAll(ctx, items, keys))
+
+		stored, err := ds.Get(ctx, "item-5")
+		require.NoError(t, err)
+		require.Equal(t, "again", stored.Name)
+	})
+}
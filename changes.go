@@ -0,0 +1,252 @@
+package cloudypg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/appliedres/cloudy/logging"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	changesSuffix   = "_changes"
+	changesFnSuffix = "_changes_fn"
+
+	// changesBuffer is the number of events Watch holds for a slow consumer
+	changesBuffer = 64
+
+	watchMinBackoff = time.Second
+	watchMaxBackoff = time.Minute
+)
+
+// Change operations reported by Watch
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+
+	// ChangeResync is sent after the listening connection was lost and
+	// restored. Changes made while it was down were missed, so consumers that
+	// keep state should reload it.
+	ChangeResync = "resync"
+)
+
+// ErrChangeFeedNotEnabled is returned by Watch when the datastore was not
+// created with WithChangeFeed
+var ErrChangeFeedNotEnabled = errors.New("change feed is not enabled for this datastore")
+
+// WithChangeFeed installs a trigger that publishes every insert, update and
+// delete on a PostgreSQL channel named after the table with a "_changes"
+// suffix, so other instances can follow the changes with Watch. Events only
+// carry the key and version, never the document, to stay well under the
+// NOTIFY payload limit. With soft delete, marking a document deleted is
+// published as a delete. Updates that change neither the document nor its
+// deleted mark, such as the MigrateToJsonb backfill, are not published.
+func WithChangeFeed() JsonDataStoreOption {
+	return func(opts *jsonDataStoreOptions) {
+		opts.changeFeed = true
+	}
+}
+
+// ChangeEvent is a single change published by the change feed trigger
+type ChangeEvent struct {
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	Key       string `json:"id"`
+	Version   int64  `json:"version"`
+	Operation string `json:"operation"`
+}
+
+var createChangeFeedSql = `
+CREATE OR REPLACE FUNCTION $CHANGESFN$() RETURNS trigger AS $cloudypg$
+DECLARE
+    op TEXT := lower(TG_OP);
+    rec RECORD;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN
+        op := 'delete';
+    END IF;
+    PERFORM pg_notify($CHANNEL$, json_build_object(
+        'schema', TG_TABLE_SCHEMA,
+        'table', TG_TABLE_NAME,
+        'id', rec.id,
+        'version', rec.version,
+        'operation', op
+    )::text);
+    RETURN rec;
+END;
+$cloudypg$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS $CHANGESTRIGGER$ ON $TABLE$;
+CREATE TRIGGER $CHANGESTRIGGER$ AFTER INSERT OR UPDATE OF data, deleted_at OR DELETE ON $TABLE$
+    FOR EACH ROW EXECUTE FUNCTION $CHANGESFN$();
+`
+
+// ChangeChannel returns the name of the channel the change feed publishes on
+func (ds *JsonDataStore[T]) ChangeChannel() string {
+	return ds.tableName.Name + changesSuffix
+}
+
+func (ds *JsonDataStore[T]) createChangeFeed(ctx context.Context, conn querier) error {
+	fn, _ := ds.tableName.WithSuffix(changesFnSuffix)
+
+	sql := strings.ReplaceAll(createChangeFeedSql, "$CHANGESFN$", fn.Sanitize())
+	sql = strings.ReplaceAll(sql, "$CHANGESTRIGGER$", QuoteIdentifier(ds.tableName.Name+changesSuffix))
+	sql = strings.ReplaceAll(sql, "$CHANNEL$", QuoteLiteral(ds.ChangeChannel()))
+	sql = ds.tableSql(sql)
+
+	_, err := conn.Exec(ctx, sql)
+	if err != nil {
+		return ds.wrapErr("create change feed", "", err)
+	}
+	return nil
+}
+
+// Watch returns a channel of the changes made to the table by any instance.
+// A connection is held for listening until the context is done, at which point
+// the channel is closed. When the connection is lost Watch reconnects with
+// backoff and sends a ChangeResync event once it is listening again.
+func (ds *JsonDataStore[T]) Watch(ctx context.Context) (<-chan ChangeEvent, error) {
+	if ds.tableErr != nil {
+		return nil, ds.tableErr
+	}
+	if !ds.opts.changeFeed {
+		return nil, ErrChangeFeedNotEnabled
+	}
+	if ds.provider == nil {
+		return nil, errors.New("no connection provider")
+	}
+
+	conn, err := ds.listen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := ds.tableSchema(ctx, conn)
+	if err != nil {
+		ds.unlisten(conn)
+		return nil, err
+	}
+
+	events := make(chan ChangeEvent, changesBuffer)
+	go ds.watch(ctx, conn, schema, events)
+	return events, nil
+}
+
+// tableSchema returns the schema of the table. The channel is not schema
+// qualified, so events from a table with the same name in another schema are
+// told apart by it.
+func (ds *JsonDataStore[T]) tableSchema(ctx context.Context, conn querier) (string, error) {
+	if ds.tableName.Schema != "" {
+		return ds.tableName.Schema, nil
+	}
+
+	var schema string
+	err := conn.QueryRow(ctx, `SELECT n.nspname FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.oid = $1::regclass`, ds.table).Scan(&schema)
+	if err != nil {
+		return "", ds.wrapErr("watch", "", err)
+	}
+	return schema, nil
+}
+
+// listen acquires a connection and subscribes it to the change channel
+func (ds *JsonDataStore[T]) listen(ctx context.Context) (*pgxpool.Conn, error) {
+	conn, err := ds.provider.Acquire(ctx)
+	if err != nil {
+		return nil, connectionError(ds.table, err)
+	}
+	_, err = conn.Exec(ctx, "LISTEN "+QuoteIdentifier(ds.ChangeChannel()))
+	if err != nil {
+		ds.provider.Return(ctx, conn)
+		return nil, ds.wrapErr("listen", "", err)
+	}
+	return conn, nil
+}
+
+// unlisten unsubscribes the connection and gives it back to the provider
+func (ds *JsonDataStore[T]) unlisten(conn *pgxpool.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = conn.Exec(ctx, "UNLISTEN *")
+	ds.provider.Return(ctx, conn)
+}
+
+func (ds *JsonDataStore[T]) watch(ctx context.Context, conn *pgxpool.Conn, schema string, events chan<- ChangeEvent) {
+	defer close(events)
+
+	send := func(ev ChangeEvent) bool {
+		select {
+		case events <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err == nil {
+			var ev ChangeEvent
+			if err = json.Unmarshal([]byte(n.Payload), &ev); err != nil {
+				continue
+			}
+			if ev.Table != ds.tableName.Name || ev.Schema != schema {
+				continue
+			}
+			if !send(ev) {
+				ds.unlisten(conn)
+				return
+			}
+			continue
+		}
+
+		if ctx.Err() != nil {
+			ds.unlisten(conn)
+			return
+		}
+
+		// The connection is gone, close it so the pool drops it
+		logging.GetLogger(ctx).WarnContext(ctx, fmt.Sprintf("Lost change feed connection for %v: %v", ds.table, err))
+		_ = conn.Conn().Close(context.Background())
+		ds.provider.Return(ctx, conn)
+
+		conn = ds.relisten(ctx)
+		if conn == nil {
+			return
+		}
+		if !send(ChangeEvent{Schema: schema, Table: ds.tableName.Name, Operation: ChangeResync}) {
+			ds.unlisten(conn)
+			return
+		}
+	}
+}
+
+// relisten keeps trying to listen again with backoff. Nil is returned when the
+// context is done first.
+func (ds *JsonDataStore[T]) relisten(ctx context.Context) *pgxpool.Conn {
+	backoff := watchMinBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		conn, err := ds.listen(ctx)
+		if err == nil {
+			return conn
+		}
+		logging.GetLogger(ctx).WarnContext(ctx, fmt.Sprintf("Unable to listen for changes on %v: %v", ds.table, err))
+		backoff = min(backoff*2, watchMaxBackoff)
+	}
+}
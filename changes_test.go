@@ -0,0 +1,127 @@
+package cloudypg
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJsonDatastoreChangeFeed(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems", WithChangeFeed(), WithSoftDelete())
+	require.NoError(t, ds.Open(ctx, nil))
+
+	wctx, cancel := context.WithCancel(ctx)
+	events, err := ds.Watch(wctx)
+	require.NoError(t, err)
+
+	next := func() ChangeEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no change event")
+		}
+		return ChangeEvent{}
+	}
+
+	item := &TestItem{ID: "1", Name: "One"}
+	require.NoError(t, ds.Save(ctx, item, item.ID))
+	require.Equal(t, ChangeEvent{Schema: "public", Table: "testitems", Key: "1", Version: 1, Operation: ChangeInsert}, next())
+
+	require.NoError(t, ds.Save(ctx, item, item.ID))
+	ev := next()
+	require.Equal(t, ChangeUpdate, ev.Operation)
+	require.Equal(t, int64(2), ev.Version)
+
+	require.NoError(t, ds.Delete(ctx, item.ID))
+	require.Equal(t, ChangeDelete, next().Operation)
+
+	// A table with the same name in another schema publishes on the same
+	// channel but its changes are not reported
+	conn, err := p.Acquire(ctx)
+	require.NoError(t, err)
+	_, err = conn.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS other")
+	p.Return(ctx, conn)
+	require.NoError(t, err)
+	other := NewJsonDatastore[TestItem](ctx, p, "other.testitems", WithChangeFeed())
+	require.NoError(t, other.Open(ctx, nil))
+	require.NoError(t, other.Save(ctx, &TestItem{ID: "2"}, "2"))
+	require.NoError(t, ds.Save(ctx, &TestItem{ID: "3"}, "3"))
+	require.Equal(t, "3", next().Key)
+
+	// Cancelling closes the channel
+	cancel()
+	require.Eventually(t, func() bool {
+		select {
+		case _, ok := <-events:
+			return !ok
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	t.Run("Not Enabled", func(t *testing.T) {
+		plain := NewJsonDatastore[TestItem](ctx, p, "testitems")
+		_, err := plain.Watch(ctx)
+		require.ErrorIs(t, err, ErrChangeFeedNotEnabled)
+	})
+}
+
+func TestJsonDatastoreChangeFeedMigrate(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "jsonitems", WithChangeFeed())
+
+	// Start from a table with a JSON data column
+	conn, err := p.Acquire(ctx)
+	require.NoError(t, err)
+	_, err = conn.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %v (
+			id varchar(200) NOT NULL PRIMARY KEY,
+			version integer DEFAULT 1,
+			last_updated timestamp DEFAULT CURRENT_TIMESTAMP,
+			date_created timestamp DEFAULT CURRENT_TIMESTAMP,
+			data json
+		);`, ds.table))
+	require.NoError(t, err)
+	p.Return(ctx, conn)
+	require.NoError(t, ds.Open(ctx, nil))
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprint(i)
+		require.NoError(t, ds.Save(ctx, &TestItem{ID: key}, key))
+	}
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events, err := ds.Watch(wctx)
+	require.NoError(t, err)
+
+	converted, err := ds.MigrateToJsonb(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), converted)
+
+	// The backfill publishes nothing, the next event is the save
+	require.NoError(t, ds.Save(ctx, &TestItem{ID: "new"}, "new"))
+	select {
+	case ev := <-events:
+		require.Equal(t, "new", ev.Key)
+		require.Equal(t, ChangeInsert, ev.Operation)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change event")
+	}
+}
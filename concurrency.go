@@ -0,0 +1,140 @@
+package cloudypg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrVersionConflict is returned by the conditional operations when the stored
+// version does not match the expected one
+var ErrVersionConflict = errors.New("version conflict")
+
+// VersionConflictError lists the keys whose stored version did not match the
+// expected version. It matches ErrVersionConflict with errors.Is.
+type VersionConflictError struct {
+	Keys []string
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict on %v", strings.Join(e.Keys, ", "))
+}
+
+func (e *VersionConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+// saveIfVersion writes the item only when the stored version matches. An
+// expected version of 0 means the key must not exist yet. The new version is
+// returned, or 0 when the version did not match.
+func (ds *JsonDataStore[T]) saveIfVersion(ctx context.Context, conn querier, item *T, key string, version int64) (int64, error) {
+	data, err := toByte(item)
+	if err != nil {
+		return 0, fmt.Errorf("error converting to json, %v", err)
+	}
+
+	var sqlSave string
+	args := []any{key, data}
+	switch {
+	case version == 0:
+		// A soft deleted or expired document does not exist for the caller
+		sqlSave = ds.createSql("version")
+	default:
+		sqlSave = fmt.Sprintf(`UPDATE %v SET version = version + 1, last_updated = CURRENT_TIMESTAMP, data = $2
+			WHERE id = $1 AND version = $3%v
+			RETURNING version`, ds.table, ds.andVisible())
+		args = append(args, version)
+	}
+
+	var newVersion int64
+	err = conn.QueryRow(ctx, sqlSave, args...).Scan(&newVersion)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, ds.wrapErr("save", key, err)
+	}
+	return newVersion, nil
+}
+
+// SaveIfVersion stores the item only if the stored version still matches the
+// expected version (as reported by GetMetadata). An expected version of 0 means
+// the key must not exist yet. The check and the write are a single statement so
+// concurrent writers can not both succeed. The new version is returned, and a
+// VersionConflictError when another writer got there first.
+func (ds *JsonDataStore[T]) SaveIfVersion(ctx context.Context, item *T, key string, version int64) (int64, error) {
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	newVersion, err := ds.saveIfVersion(ctx, conn, item, key, version)
+	if err != nil {
+		return 0, err
+	}
+	if newVersion == 0 {
+		return 0, &VersionConflictError{Keys: []string{key}}
+	}
+	return newVersion, nil
+}
+
+// SaveAllIfVersion is the batch form of SaveIfVersion. The items are written in
+// a single transaction and if any version does not match nothing is written and
+// the returned VersionConflictError lists every conflicting key.
+func (ds *JsonDataStore[T]) SaveAllIfVersion(ctx context.Context, items []*T, keys []string, versions []int64) error {
+	if len(items) != len(keys) || len(items) != len(versions) {
+		return errors.New("items, keys and versions must be the same length")
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		var conflicts []string
+		for i, item := range items {
+			newVersion, err := ds.saveIfVersion(ctx, tx, item, keys[i], versions[i])
+			if err != nil {
+				return err
+			}
+			if newVersion == 0 {
+				conflicts = append(conflicts, keys[i])
+			}
+		}
+		if len(conflicts) > 0 {
+			return &VersionConflictError{Keys: conflicts}
+		}
+		return nil
+	})
+	return ds.wrapErr("save", "", err)
+}
+
+// DeleteIfVersion deletes the item only if the stored version still matches
+// the expected version. A VersionConflictError is returned when the version
+// changed or the key no longer exists.
+func (ds *JsonDataStore[T]) DeleteIfVersion(ctx context.Context, key string, version int64) error {
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	sqlDelete := fmt.Sprintf(`DELETE FROM %v WHERE id = $1 AND version = $2`, ds.table)
+	if ds.opts.softDelete {
+		sqlDelete = fmt.Sprintf(`UPDATE %v SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1 AND version = $2 AND deleted_at IS NULL`, ds.table)
+	}
+	tag, err := conn.Exec(ctx, sqlDelete, key, version)
+	if err != nil {
+		return ds.wrapErr("delete", key, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return &VersionConflictError{Keys: []string{key}}
+	}
+	return nil
+}
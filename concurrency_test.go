@@ -0,0 +1,73 @@
+package cloudypg
+
+import (
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJsonDatastoreVersioning(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems")
+	require.NoError(t, ds.Open(ctx, nil))
+
+	item := &TestItem{ID: "1", Name: "First"}
+
+	// Version 0 means create only
+	v, err := ds.SaveIfVersion(ctx, item, item.ID, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), v)
+
+	_, err = ds.SaveIfVersion(ctx, item, item.ID, 0)
+	require.ErrorIs(t, err, ErrVersionConflict)
+
+	item.Name = "Second"
+	v, err = ds.SaveIfVersion(ctx, item, item.ID, 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), v)
+
+	// A stale writer loses
+	item.Name = "Stale"
+	_, err = ds.SaveIfVersion(ctx, item, item.ID, 1)
+	require.ErrorIs(t, err, ErrVersionConflict)
+
+	stored, err := ds.Get(ctx, item.ID)
+	require.NoError(t, err)
+	require.Equal(t, "Second", stored.Name)
+
+	t.Run("SaveAll", func(t *testing.T) {
+		a := &TestItem{ID: "a", Name: "A"}
+		b := &TestItem{ID: "b", Name: "B"}
+		require.NoError(t, ds.SaveAllIfVersion(ctx, []*TestItem{a, b}, []string{a.ID, b.ID}, []int64{0, 0}))
+
+		// One stale version rolls back the whole batch
+		a.Name = "A2"
+		b.Name = "B2"
+		err := ds.SaveAllIfVersion(ctx, []*TestItem{a, b}, []string{a.ID, b.ID}, []int64{1, 5})
+		require.ErrorIs(t, err, ErrVersionConflict)
+		var conflict *VersionConflictError
+		require.ErrorAs(t, err, &conflict)
+		require.Equal(t, []string{"b"}, conflict.Keys)
+
+		stored, err := ds.Get(ctx, a.ID)
+		require.NoError(t, err)
+		require.Equal(t, "A", stored.Name)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		err := ds.DeleteIfVersion(ctx, item.ID, 1)
+		require.ErrorIs(t, err, ErrVersionConflict)
+
+		require.NoError(t, ds.DeleteIfVersion(ctx, item.ID, 2))
+
+		exists, err := ds.Exists(ctx, item.ID)
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+}
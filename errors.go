@@ -0,0 +1,152 @@
+package cloudypg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// The kinds of failure reported by the datastores. Use errors.Is to check for
+// them and errors.As with *pgconn.PgError to get the SQLSTATE and constraint
+// of a database error. Version conflicts are reported with ErrVersionConflict.
+var (
+	// ErrNotFound is returned when the document or key does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrAlreadyExists is returned by Create when the key is already used
+	ErrAlreadyExists = errors.New("already exists")
+
+	// ErrUniqueViolation is returned when a write breaks a unique constraint,
+	// including the primary key
+	ErrUniqueViolation = errors.New("unique violation")
+
+	// ErrSerialization is returned when the database aborted the transaction
+	// because of a serialization failure or deadlock. The operation can be
+	// retried.
+	ErrSerialization = errors.New("serialization failure")
+
+	// ErrTimeout is returned when the operation ran out of time, either from
+	// the context deadline or a statement or lock timeout in the database
+	ErrTimeout = errors.New("timeout")
+
+	// ErrConnection is returned when the connection to the database could not
+	// be made or was lost
+	ErrConnection = errors.New("connection lost")
+
+	// ErrInvalidQuery is returned when a query has an unknown or malformed
+	// condition, such as an invalid LIKE or regular expression pattern
+	ErrInvalidQuery = errors.New("invalid query")
+)
+
+// Error is returned by the datastore operations for database failures. Kind is
+// one of the sentinel errors above, or nil when the failure does not match any
+// of them, and Err is the underlying error which is often a *pgconn.PgError.
+type Error struct {
+	Op    string
+	Table string
+	Key   string
+	Kind  error
+	Err   error
+}
+
+func (e *Error) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.Op)
+	if e.Table != "" {
+		sb.WriteString(" " + e.Table)
+	}
+	if e.Key != "" {
+		sb.WriteString(" " + e.Key)
+	}
+	if e.Kind != nil {
+		sb.WriteString(": " + e.Kind.Error())
+	}
+	if e.Err != nil {
+		sb.WriteString(": " + e.Err.Error())
+	}
+	return sb.String()
+}
+
+func (e *Error) Unwrap() []error {
+	var errs []error
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// errorKind maps an error from pgx to one of the sentinel errors
+func errorKind(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == "23505":
+			return ErrUniqueViolation
+		case pgErr.Code == "40001" || pgErr.Code == "40P01":
+			return ErrSerialization
+		case pgErr.Code == "57014" || pgErr.Code == "55P03" || pgErr.Code == "25P03":
+			return ErrTimeout
+		case strings.HasPrefix(pgErr.Code, "08") || pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03":
+			return ErrConnection
+		case pgErr.Code == "2201B" || pgErr.Code == "22025":
+			return ErrInvalidQuery
+		}
+		return nil
+	}
+
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return ErrNotFound
+	case errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err):
+		return ErrTimeout
+	case errors.As(err, &connectErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return ErrConnection
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return ErrTimeout
+		}
+		return ErrConnection
+	}
+	return nil
+}
+
+// newError wraps a database error with the operation and the kind of failure.
+// Errors that are already wrapped are returned as they are.
+func newError(op string, table string, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var dsErr *Error
+	if errors.As(err, &dsErr) {
+		return err
+	}
+	var conflict *VersionConflictError
+	if errors.As(err, &conflict) {
+		return err
+	}
+	return &Error{Op: op, Table: table, Key: key, Kind: errorKind(err), Err: err}
+}
+
+// notFoundError reports a missing key
+func notFoundError(op string, table string, key string) error {
+	return &Error{Op: op, Table: table, Key: key, Kind: ErrNotFound}
+}
+
+// connectionError reports a failure to get a connection from the provider
+func connectionError(table string, err error) error {
+	kind := errorKind(err)
+	if kind == nil {
+		kind = ErrConnection
+	}
+	return &Error{Op: "connect", Table: table, Kind: kind, Err: err}
+}
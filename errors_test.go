@@ -0,0 +1,98 @@
+package cloudypg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorKinds(t *testing.T) {
+	for code, kind := range map[string]error{
+		"23505": ErrUniqueViolation,
+		"40001": ErrSerialization,
+		"40P01": ErrSerialization,
+		"2201B": ErrInvalidQuery,
+		"57014": ErrTimeout,
+		"55P03": ErrTimeout,
+		"08006": ErrConnection,
+		"57P01": ErrConnection,
+	} {
+		pgErr := &pgconn.PgError{Code: code, ConstraintName: "testitems_pkey"}
+		err := newError("save", "testitems", "1", fmt.Errorf("wrapped: %w", pgErr))
+		require.ErrorIs(t, err, kind, code)
+
+		var found *pgconn.PgError
+		require.ErrorAs(t, err, &found)
+		require.Equal(t, "testitems_pkey", found.ConstraintName)
+	}
+
+	// The key being in use is found by Create itself, the message is translated
+	err := newError("create", "testitems", "1", &pgconn.PgError{Code: "23505", Detail: "Key (id)=(1) already exists."})
+	require.ErrorIs(t, err, ErrUniqueViolation)
+	require.NotErrorIs(t, err, ErrAlreadyExists)
+
+	err = newError("get", "testitems", "1", pgx.ErrNoRows)
+	require.ErrorIs(t, err, ErrNotFound)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+	require.Equal(t, "get testitems 1: not found: no rows in result set", err.Error())
+
+	require.ErrorIs(t, newError("query", "testitems", "", context.DeadlineExceeded), ErrTimeout)
+	require.Nil(t, newError("query", "testitems", "", nil))
+
+	// Already wrapped errors are kept
+	require.Same(t, err, newError("other", "", "", err))
+
+	var conflict error = &VersionConflictError{Keys: []string{"1"}}
+	require.Same(t, conflict, newError("save", "testitems", "1", conflict))
+
+	err = newError("query", "testitems", "", errors.New("syntax"))
+	var dsErr *Error
+	require.ErrorAs(t, err, &dsErr)
+	require.Nil(t, dsErr.Kind)
+}
+
+func TestJsonDatastoreErrors(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "erroritems", WithIndexes(Index{Fields: []string{"name"}, Unique: true}))
+	require.NoError(t, ds.Open(ctx, nil))
+
+	_, err := ds.GetExisting(ctx, "missing")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	item, err := ds.Get(ctx, "missing")
+	require.NoError(t, err)
+	require.Nil(t, item)
+
+	require.NoError(t, ds.Save(ctx, &TestItem{ID: "1", Name: "same"}, "1"))
+	err = ds.Save(ctx, &TestItem{ID: "2", Name: "same"}, "2")
+	require.ErrorIs(t, err, ErrUniqueViolation)
+
+	var pgErr *pgconn.PgError
+	require.ErrorAs(t, err, &pgErr)
+	require.Equal(t, "erroritems_name_key", pgErr.ConstraintName)
+
+	require.ErrorIs(t, ds.Create(ctx, &TestItem{ID: "1", Name: "other"}, "1"), ErrAlreadyExists)
+	require.ErrorIs(t, ds.Create(ctx, &TestItem{ID: "3", Name: "same"}, "3"), ErrUniqueViolation)
+
+	_, err = ds.MergePatch(ctx, "missing", []byte(`{"name": "x"}`))
+	require.ErrorIs(t, err, ErrNotFound)
+
+	q := datastore.NewQuery()
+	q.Conditions.Equals("name", "same")
+	timeout, cancel := context.WithTimeout(ctx, 0)
+	defer cancel()
+	_, err = ds.Query(timeout, q)
+	require.ErrorIs(t, err, ErrTimeout)
+}
@@ -0,0 +1,177 @@
+package cloudypg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/appliedres/cloudy/logging"
+)
+
+const notExpiredCondition = "(%vexpires_at IS NULL OR %vexpires_at > CURRENT_TIMESTAMP)"
+
+const (
+	// DefaultReapInterval is how often the reaper looks for expired documents
+	// when no interval is given
+	DefaultReapInterval = time.Minute
+
+	// DefaultReapBatchSize is the number of expired documents deleted per
+	// statement when no batch size is given
+	DefaultReapBatchSize = 500
+)
+
+// WithExpiry lets documents be saved with an expiry time using SaveWithTTL and
+// SaveWithExpiry. Expired documents are hidden from every read and are removed
+// by DeleteExpired or the reaper started with StartReaper. Saving a document
+// again with Save clears its expiry. Open adds a partial index on the expiry
+// time so finding expired documents stays cheap.
+func WithExpiry() JsonDataStoreOption {
+	return func(opts *jsonDataStoreOptions) {
+		opts.expiry = true
+	}
+}
+
+// ReaperConfig configures the background reaper started by StartReaper
+type ReaperConfig struct {
+	// Interval between runs, DefaultReapInterval when zero
+	Interval time.Duration
+
+	// BatchSize is the number of documents deleted per statement,
+	// DefaultReapBatchSize when zero
+	BatchSize int
+
+	// Leader, when set, limits the reaping to the instance that is the leader
+	Leader *PgLeader
+}
+
+// expiryIndexName is the name of the partial index the reaper uses to find
+// expired documents
+func (ds *JsonDataStore[T]) expiryIndexName() string {
+	return shortenIdentifier(ds.tableName.Name + "_expires_at_partial")
+}
+
+// createExpiryIndex indexes the documents that have an expiry so DeleteExpired
+// does not scan the whole table
+func (ds *JsonDataStore[T]) createExpiryIndex(ctx context.Context, conn querier) error {
+	name := ds.expiryIndexName()
+	create := fmt.Sprintf("IF NOT EXISTS %v ON %v (expires_at) WHERE expires_at IS NOT NULL", QuoteIdentifier(name), ds.table)
+	err := execConcurrently(ctx, conn, "CREATE INDEX CONCURRENTLY "+create, "CREATE INDEX "+create)
+	if err != nil {
+		return ds.wrapErr("create index", name, err)
+	}
+	return nil
+}
+
+// saveExpiring upserts the document with the expiry given by the SQL
+// expression, which uses $3
+func (ds *JsonDataStore[T]) saveExpiring(ctx context.Context, item *T, key string, expires string, arg any) error {
+	if !ds.opts.expiry {
+		return fmt.Errorf("expiry is not enabled for %v", ds.table)
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	data, err := toByte(item)
+	if err != nil {
+		return fmt.Errorf("error converting to json, %v", err)
+	}
+
+	undelete := ""
+	if ds.opts.softDelete {
+		undelete = ", deleted_at = NULL"
+	}
+	sqlSave := fmt.Sprintf(`INSERT INTO %v AS t (id, data, expires_at) VALUES ($1, $2, %v)
+		ON CONFLICT (id) DO UPDATE
+		SET version = t.version + 1, last_updated = CURRENT_TIMESTAMP, data = $2, expires_at = EXCLUDED.expires_at%v`,
+		ds.table, expires, undelete)
+
+	_, err = conn.Exec(ctx, sqlSave, key, data, arg)
+	if err != nil {
+		return ds.wrapErr("save", key, err)
+	}
+	return nil
+}
+
+// SaveWithTTL stores an item that expires once the ttl has passed. The expiry
+// time is computed by the database so the clocks of the instances do not
+// matter.
+func (ds *JsonDataStore[T]) SaveWithTTL(ctx context.Context, item *T, key string, ttl time.Duration) error {
+	return ds.saveExpiring(ctx, item, key, "CURRENT_TIMESTAMP + make_interval(secs => $3)", ttl.Seconds())
+}
+
+// SaveWithExpiry stores an item that expires at the given time
+func (ds *JsonDataStore[T]) SaveWithExpiry(ctx context.Context, item *T, key string, at time.Time) error {
+	return ds.saveExpiring(ctx, item, key, "$3::timestamptz", at)
+}
+
+// DeleteExpired removes the expired documents, batchSize at a time, and
+// returns the number removed. Rows locked by another instance doing the same
+// are skipped, so any number of instances can run it at once.
+func (ds *JsonDataStore[T]) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	if !ds.opts.expiry {
+		return 0, fmt.Errorf("expiry is not enabled for %v", ds.table)
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultReapBatchSize
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	sqlDelete := fmt.Sprintf(`DELETE FROM %v WHERE id IN (
+			SELECT id FROM %v WHERE expires_at <= CURRENT_TIMESTAMP LIMIT $1 FOR UPDATE SKIP LOCKED
+		)`, ds.table, ds.table)
+
+	var deleted int64
+	for {
+		tag, err := conn.Exec(ctx, sqlDelete, batchSize)
+		if err != nil {
+			return deleted, ds.wrapErr("delete expired", "", err)
+		}
+		deleted += tag.RowsAffected()
+		if tag.RowsAffected() < int64(batchSize) {
+			return deleted, nil
+		}
+	}
+}
+
+// StartReaper deletes expired documents in the background until the context is
+// done. Failures are logged and retried on the next run.
+func (ds *JsonDataStore[T]) StartReaper(ctx context.Context, cfg ReaperConfig) {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = DefaultReapInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if cfg.Leader != nil && !cfg.Leader.IsLeader() {
+				continue
+			}
+			deleted, err := ds.DeleteExpired(ctx, cfg.BatchSize)
+			if err != nil {
+				logging.GetLogger(ctx).WarnContext(ctx, fmt.Sprintf("Unable to delete expired documents from %v: %v", ds.table, err))
+				continue
+			}
+			if deleted > 0 {
+				logging.GetLogger(ctx).DebugContext(ctx, fmt.Sprintf("Deleted %v expired documents from %v", deleted, ds.table))
+			}
+		}
+	}()
+}
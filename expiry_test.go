@@ -0,0 +1,91 @@
+package cloudypg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiryCondition(t *testing.T) {
+	ds := NewJsonDatastore[TestItem](context.Background(), nil, "testitems", WithSoftDelete(), WithExpiry())
+	require.Equal(t, "t.deleted_at IS NULL AND (t.expires_at IS NULL OR t.expires_at > CURRENT_TIMESTAMP)", ds.visibleCondition("t"))
+	require.Equal(t, ", deleted_at = NULL, expires_at = NULL", ds.reviveSet())
+	require.Equal(t, "testitems_expires_at_partial", ds.expiryIndexName())
+}
+
+func TestJsonDatastoreExpiry(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems", WithExpiry())
+	require.NoError(t, ds.Open(ctx, nil))
+
+	// Opening again keeps the partial index used by the reaper
+	require.NoError(t, ds.Open(ctx, nil))
+	conn, err := p.Acquire(ctx)
+	require.NoError(t, err)
+	var indexDef string
+	err = conn.QueryRow(ctx, "SELECT indexdef FROM pg_indexes WHERE indexname = $1", ds.expiryIndexName()).Scan(&indexDef)
+	p.Return(ctx, conn)
+	require.NoError(t, err)
+	require.Contains(t, indexDef, "WHERE (expires_at IS NOT NULL)")
+
+	require.NoError(t, ds.SaveWithTTL(ctx, &TestItem{ID: "session", Name: "live"}, "session", time.Hour))
+	require.NoError(t, ds.SaveWithExpiry(ctx, &TestItem{ID: "token", Name: "used"}, "token", time.Now().Add(-time.Minute)))
+	require.NoError(t, ds.Save(ctx, &TestItem{ID: "plain", Name: "live"}, "plain"))
+
+	item, err := ds.Get(ctx, "token")
+	require.NoError(t, err)
+	require.Nil(t, item)
+
+	all, err := ds.GetAll(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+
+	q := datastore.NewQuery()
+	cnt, err := ds.Count(ctx, q)
+	require.NoError(t, err)
+	require.Equal(t, 2, cnt)
+
+	// Creating over an expired document replaces it
+	require.NoError(t, ds.Create(ctx, &TestItem{ID: "token", Name: "new"}, "token"))
+	item, err = ds.Get(ctx, "token")
+	require.NoError(t, err)
+	require.Equal(t, "new", item.Name)
+
+	t.Run("Delete Expired", func(t *testing.T) {
+		for _, key := range []string{"a", "b", "c"} {
+			require.NoError(t, ds.SaveWithExpiry(ctx, &TestItem{ID: key}, key, time.Now().Add(-time.Second)))
+		}
+		deleted, err := ds.DeleteExpired(ctx, 2)
+		require.NoError(t, err)
+		require.Equal(t, int64(3), deleted)
+	})
+
+	t.Run("Reaper", func(t *testing.T) {
+		require.NoError(t, ds.SaveWithTTL(ctx, &TestItem{ID: "short"}, "short", 100*time.Millisecond))
+
+		rctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		ds.StartReaper(rctx, ReaperConfig{Interval: 100 * time.Millisecond})
+
+		// A store without expiry still sees the row until it is reaped
+		raw := NewJsonDatastore[TestItem](ctx, p, "testitems")
+		require.Eventually(t, func() bool {
+			exists, err := raw.Exists(ctx, "short")
+			return err == nil && !exists
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("Not Enabled", func(t *testing.T) {
+		plain := NewJsonDatastore[TestItem](ctx, p, "testitems")
+		require.Error(t, plain.SaveWithTTL(ctx, &TestItem{ID: "x"}, "x", time.Hour))
+	})
+}
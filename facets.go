@@ -0,0 +1,132 @@
+package cloudypg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultFacetLimit is the number of values returned for a facet without a
+// limit
+const DefaultFacetLimit = 10
+
+// Facet asks for the distinct values of a field among the documents matching a
+// query, with the number of documents for each
+type Facet struct {
+	Field string
+
+	// Array counts each element of an array field as a value
+	Array bool
+
+	// Limit is the most values returned, the most common first.
+	// DefaultFacetLimit is used when 0 and every value when negative.
+	Limit int
+}
+
+// FacetValue is a distinct value of a facet and the number of documents with it
+type FacetValue struct {
+	Value string
+	Count int64
+}
+
+// ConvertFacetsWithArgs converts the query and facets into a single SELECT of
+// the facet index, value and count. The conditions are converted exactly as
+// for Query, and the sort and paging of the query are ignored.
+func (qc *PgQueryConverter) ConvertFacetsWithArgs(q *datastore.SimpleQuery, table string, facets []Facet) (string, []any) {
+	inner := *q
+	inner.Colums, inner.SortBy, inner.Size, inner.Offset = nil, nil, 0, 0
+	matched, _ := qc.ConvertWithArgs(&inner, table)
+	if len(facets) == 0 {
+		qc.fail("no facets given")
+	}
+
+	parts := make([]string, len(facets))
+	for i, f := range facets {
+		if f.Field == "" {
+			qc.fail("facet %v needs a field", i)
+		}
+
+		var sql string
+		if f.Array {
+			arr := qc.asJsonb(qc.toJsonField(f.Field))
+			sql = fmt.Sprintf("SELECT %v AS facet, v AS value, count(*) AS cnt FROM matched, "+
+				"jsonb_array_elements_text(CASE WHEN jsonb_typeof(%v) = 'array' THEN %v END) AS v GROUP BY v", i, arr, arr)
+		} else {
+			field := qc.toField(f.Field)
+			sql = fmt.Sprintf("SELECT %v AS facet, %v AS value, count(*) AS cnt FROM matched WHERE %v IS NOT NULL GROUP BY %v", i, field, field, field)
+		}
+		sql += " ORDER BY cnt DESC, value"
+
+		limit := f.Limit
+		if limit == 0 {
+			limit = DefaultFacetLimit
+		}
+		if limit > 0 {
+			sql += fmt.Sprintf(" LIMIT %v", limit)
+		}
+		parts[i] = "(" + sql + ")"
+	}
+
+	return fmt.Sprintf("WITH matched AS (%v) %v", matched, strings.Join(parts, " UNION ALL ")), qc.args
+}
+
+// Facets returns the distinct values of each facet among the documents
+// matching the query, keyed by the facet field. The values are ordered by
+// count, the most common first, and documents without a value for the field
+// are left out. The facets use the same conditions as Query so the counts
+// match its results.
+func (ds *JsonDataStore[T]) Facets(ctx context.Context, query *datastore.SimpleQuery, facets ...Facet) (map[string][]FacetValue, error) {
+	if query == nil {
+		query = datastore.NewQuery()
+	}
+
+	qc := ds.converter()
+	sql, args := qc.ConvertFacetsWithArgs(query, ds.table, facets)
+	if err := qc.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, ds.wrapErr("facets", "", err)
+	}
+
+	rtn := make(map[string][]FacetValue, len(facets))
+	for _, f := range facets {
+		rtn[f.Field] = []FacetValue{}
+	}
+	var i int
+	var v FacetValue
+	_, err = pgx.ForEachRow(rows, []any{&i, &v.Value, &v.Count}, func() error {
+		field := facets[i].Field
+		rtn[field] = append(rtn[field], v)
+		return nil
+	})
+	if err != nil {
+		return nil, ds.wrapErr("facets", "", err)
+	}
+	return rtn, nil
+}
+
+// Distinct returns every distinct value of the field among the documents
+// matching the query, the most common first
+func (ds *JsonDataStore[T]) Distinct(ctx context.Context, query *datastore.SimpleQuery, field string) ([]string, error) {
+	facets, err := ds.Facets(ctx, query, Facet{Field: field, Limit: -1})
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, len(facets[field]))
+	for i, v := range facets[field] {
+		values[i] = v.Value
+	}
+	return values, nil
+}
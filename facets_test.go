@@ -0,0 +1,70 @@
+package cloudypg
+
+import (
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertFacetsWithArgs(t *testing.T) {
+	q := datastore.NewQuery()
+	q.Conditions.Equals("status", "paid")
+	q.SortBy = []*datastore.SortBy{{Field: "amount"}}
+	q.Size = 10
+
+	qc := &PgQueryConverter{jsonb: true}
+	sql, args := qc.ConvertFacetsWithArgs(q, "orders", []Facet{
+		{Field: "customer"},
+		{Field: "tags", Array: true, Limit: 3},
+	})
+	require.NoError(t, qc.Err())
+	require.Equal(t, "WITH matched AS (SELECT data FROM orders WHERE (data->>'status') = $1)"+
+		" (SELECT 0 AS facet, data->>'customer' AS value, count(*) AS cnt FROM matched WHERE data->>'customer' IS NOT NULL GROUP BY data->>'customer' ORDER BY cnt DESC, value LIMIT 10)"+
+		" UNION ALL (SELECT 1 AS facet, v AS value, count(*) AS cnt FROM matched, jsonb_array_elements_text(CASE WHEN jsonb_typeof(data->'tags') = 'array' THEN data->'tags' END) AS v GROUP BY v ORDER BY cnt DESC, value LIMIT 3)", sql)
+	require.Equal(t, []any{"paid"}, args)
+
+	qc.ConvertFacetsWithArgs(q, "orders", nil)
+	require.ErrorIs(t, qc.Err(), ErrInvalidQuery)
+}
+
+func TestJsonDatastoreFacets(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[Order](ctx, p, "orders", WithSoftDelete())
+	require.NoError(t, ds.Open(ctx, nil))
+
+	for _, o := range []*Order{
+		{ID: "1", Customer: "acme", Status: "paid", Tags: []string{"rush", "gift"}},
+		{ID: "2", Customer: "acme", Status: "paid", Tags: []string{"rush"}},
+		{ID: "3", Customer: "globex", Status: "paid"},
+		{ID: "4", Customer: "globex", Status: "open", Tags: []string{"gift"}},
+		{ID: "5", Customer: "initech", Status: "paid", Tags: []string{"rush"}},
+	} {
+		require.NoError(t, ds.Save(ctx, o, o.ID))
+	}
+	require.NoError(t, ds.Delete(ctx, "5"))
+
+	q := datastore.NewQuery()
+	q.Conditions.Equals("status", "paid")
+
+	facets, err := ds.Facets(ctx, q,
+		Facet{Field: "customer", Limit: 1},
+		Facet{Field: "tags", Array: true},
+		Facet{Field: "missing"})
+	require.NoError(t, err)
+	require.Equal(t, map[string][]FacetValue{
+		"customer": {{Value: "acme", Count: 2}},
+		"tags":     {{Value: "rush", Count: 2}, {Value: "gift", Count: 1}},
+		"missing":  {},
+	}, facets)
+
+	values, err := ds.Distinct(ctx, nil, "customer")
+	require.NoError(t, err)
+	require.Equal(t, []string{"acme", "globex"}, values)
+}
@@ -0,0 +1,211 @@
+package cloudypg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// FieldOp is an atomic change to a single field of a document, applied by
+// UpdateFields and UpdateFieldsWhere. Fields are dotted paths as used in
+// SimpleQuery and the parent of the field must already exist.
+type FieldOp struct {
+	field  string
+	kind   string
+	value  any
+	values []any
+}
+
+// Increment adds to the number at the field, treating a missing field as 0
+func Increment(field string, by float64) FieldOp {
+	return FieldOp{field: field, kind: "increment", value: by}
+}
+
+// Decrement subtracts from the number at the field, treating a missing field as 0
+func Decrement(field string, by float64) FieldOp {
+	return Increment(field, -by)
+}
+
+// AppendValues adds the values to the end of the array at the field, creating
+// the array when it is missing
+func AppendValues(field string, values ...any) FieldOp {
+	return FieldOp{field: field, kind: "append", values: values}
+}
+
+// RemoveValues removes every element equal to one of the values from the array
+// at the field
+func RemoveValues(field string, values ...any) FieldOp {
+	return FieldOp{field: field, kind: "remove", values: values}
+}
+
+// AddToSet appends the values that are not already in the array at the field,
+// creating the array when it is missing
+func AddToSet(field string, values ...any) FieldOp {
+	return FieldOp{field: field, kind: "addToSet", values: values}
+}
+
+// SetField sets the field to the value
+func SetField(field string, value any) FieldOp {
+	return FieldOp{field: field, kind: "set", value: value}
+}
+
+// UnsetField removes the field from the document
+func UnsetField(field string) FieldOp {
+	return FieldOp{field: field, kind: "unset"}
+}
+
+// jsonArg adds the value as JSON and returns the JSONB placeholder
+func (qc *PgQueryConverter) jsonArg(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return qc.arg(string(data)) + "::jsonb", nil
+}
+
+// convertFieldOps builds the new document from the stored one. Every operation
+// reads its current value from the stored document and the results are applied
+// in order, so each field may only appear once.
+func (qc *PgQueryConverter) convertFieldOps(ops []FieldOp) (string, error) {
+	if len(ops) == 0 {
+		return "", errors.New("no field operations")
+	}
+
+	data := qc.asJsonb("data")
+	doc := data
+	seen := make(map[string]bool)
+	for _, op := range ops {
+		if seen[op.field] {
+			return "", fmt.Errorf("field %v is changed more than once", op.field)
+		}
+		seen[op.field] = true
+
+		p := qc.arg(gabs.DotPathToSlice(op.field)) + "::text[]"
+		current := fmt.Sprintf("(%v #> %v)", data, p)
+
+		var values string
+		if op.values != nil {
+			var err error
+			if values, err = qc.jsonArg(uniqueValues(op.values)); err != nil {
+				return "", fmt.Errorf("error converting values of %v to json, %v", op.field, err)
+			}
+		}
+
+		switch op.kind {
+		case "increment":
+			doc = fmt.Sprintf("jsonb_set(%v, %v, to_jsonb(COALESCE((%v #>> %v)::numeric, 0) + %v::numeric), true)",
+				doc, p, data, p, qc.arg(op.value))
+		case "append":
+			doc = fmt.Sprintf("jsonb_set(%v, %v, COALESCE(%v, '[]'::jsonb) || %v, true)", doc, p, current, values)
+		case "remove":
+			doc = fmt.Sprintf(`jsonb_set(%v, %v, (SELECT COALESCE(jsonb_agg(e ORDER BY i), '[]'::jsonb)
+				FROM jsonb_array_elements(%v) WITH ORDINALITY AS x(e, i)
+				WHERE e NOT IN (SELECT jsonb_array_elements(%v))), false)`, doc, p, current, values)
+		case "addToSet":
+			doc = fmt.Sprintf(`jsonb_set(%[1]v, %[2]v, COALESCE(%[3]v, '[]'::jsonb) || (SELECT COALESCE(jsonb_agg(e ORDER BY i), '[]'::jsonb)
+				FROM jsonb_array_elements(%[4]v) WITH ORDINALITY AS x(e, i)
+				WHERE e NOT IN (SELECT jsonb_array_elements(COALESCE(%[3]v, '[]'::jsonb)))), true)`, doc, p, current, values)
+		case "set":
+			value, err := qc.jsonArg(op.value)
+			if err != nil {
+				return "", fmt.Errorf("error converting value of %v to json, %v", op.field, err)
+			}
+			doc = fmt.Sprintf("jsonb_set(%v, %v, %v, true)", doc, p, value)
+		case "unset":
+			doc = fmt.Sprintf("(%v #- %v)", doc, p)
+		default:
+			return "", fmt.Errorf("unknown field operation %v", op.kind)
+		}
+	}
+	return doc, nil
+}
+
+// uniqueValues drops repeated values so AddToSet does not add the same value twice
+func uniqueValues(values []any) []any {
+	seen := make(map[string]bool)
+	unique := make([]any, 0, len(values))
+	for _, v := range values {
+		data, err := json.Marshal(v)
+		if err == nil {
+			if seen[string(data)] {
+				continue
+			}
+			seen[string(data)] = true
+		}
+		unique = append(unique, v)
+	}
+	return unique
+}
+
+// fieldOpsSet returns the SET clause applying the operations
+func (ds *JsonDataStore[T]) fieldOpsSet(qc *PgQueryConverter, ops []FieldOp) (string, error) {
+	doc, err := qc.convertFieldOps(ops)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("data = (%v)%v, version = version + 1, last_updated = CURRENT_TIMESTAMP", doc, ds.dataCast()), nil
+}
+
+// UpdateFields atomically applies the field operations to the document in a
+// single statement, so concurrent increments and array changes are never lost.
+// The version is bumped and the updated keys are returned, which is empty when
+// the key does not exist.
+func (ds *JsonDataStore[T]) UpdateFields(ctx context.Context, key string, ops ...FieldOp) ([]string, error) {
+	qc := ds.converter()
+	set, err := ds.fieldOpsSet(qc, ops)
+	if err != nil {
+		return nil, err
+	}
+	sqlUpdate := fmt.Sprintf("UPDATE %v SET %v WHERE id = %v%v RETURNING id", ds.table, set, qc.arg(key), ds.andVisible())
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	return ds.collectKeys(ctx, conn, "update fields", sqlUpdate, qc.args)
+}
+
+// UpdateFieldsWhere atomically applies the field operations to every document
+// matching the query in a single statement and returns the updated keys
+func (ds *JsonDataStore[T]) UpdateFieldsWhere(ctx context.Context, query *datastore.SimpleQuery, ops ...FieldOp) ([]string, error) {
+	qc := ds.converter()
+	set, err := ds.fieldOpsSet(qc, ops)
+	if err != nil {
+		return nil, err
+	}
+	sqlUpdate, args := qc.ConvertUpdateWithArgs(query, ds.table, set, qc.args...)
+	if err := qc.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	return ds.collectKeys(ctx, conn, "update fields", sqlUpdate, args)
+}
+
+// collectKeys runs a statement returning ids and collects them
+func (ds *JsonDataStore[T]) collectKeys(ctx context.Context, conn querier, op string, sql string, args []any) ([]string, error) {
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, ds.wrapErr(op, "", err)
+	}
+	keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, ds.wrapErr(op, "", err)
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	return keys, nil
+}
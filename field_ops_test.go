@@ -0,0 +1,99 @@
+package cloudypg
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertFieldOps(t *testing.T) {
+	qc := &PgQueryConverter{jsonb: true}
+	sql, err := qc.convertFieldOps([]FieldOp{Increment("stats.count", 2), UnsetField("old")})
+	require.NoError(t, err)
+	require.Equal(t, "(jsonb_set(data, $1::text[], to_jsonb(COALESCE((data #>> $1::text[])::numeric, 0) + $2::numeric), true) #- $3::text[])", sql)
+	require.Equal(t, []any{[]string{"stats", "count"}, 2.0, []string{"old"}}, qc.args)
+
+	_, err = new(PgQueryConverter).convertFieldOps([]FieldOp{SetField("a", 1), Increment("a", 1)})
+	require.Error(t, err)
+
+	_, err = new(PgQueryConverter).convertFieldOps(nil)
+	require.Error(t, err)
+}
+
+func TestJsonDatastoreFieldOps(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[map[string]any](ctx, p, "counteritems")
+	require.NoError(t, ds.Open(ctx, nil))
+
+	for _, key := range []string{"1", "2", "3"} {
+		doc := map[string]any{"group": "a", "count": 0, "tags": []any{"x"}}
+		if key == "3" {
+			doc["group"] = "b"
+		}
+		require.NoError(t, ds.Save(ctx, &doc, key))
+	}
+
+	// Concurrent increments are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys, err := ds.UpdateFields(ctx, "1", Increment("count", 1))
+			require.NoError(t, err)
+			require.Equal(t, []string{"1"}, keys)
+		}()
+	}
+	wg.Wait()
+
+	item, err := ds.Get(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, 20.0, (*item)["count"])
+
+	meta, err := ds.GetMetadata(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, int64(21), meta[0].Version)
+
+	keys, err := ds.UpdateFields(ctx, "1",
+		AppendValues("tags", "y", "z"),
+		SetField("name", "one"),
+		Decrement("count", 5),
+		UnsetField("group"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, keys)
+
+	item, err = ds.Get(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"count": 15.0, "tags": []any{"x", "y", "z"}, "name": "one"}, *item)
+
+	keys, err = ds.UpdateFields(ctx, "1", RemoveValues("tags", "x", "z"), AddToSet("labels", "l1", "l1"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, keys)
+
+	item, err = ds.Get(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, []any{"y"}, (*item)["tags"])
+	require.Equal(t, []any{"l1"}, (*item)["labels"])
+
+	q := datastore.NewQuery()
+	q.Conditions.Equals("group", "a")
+	keys, err = ds.UpdateFieldsWhere(ctx, q, AddToSet("tags", "x", "w"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"2"}, keys)
+
+	item, err = ds.Get(ctx, "2")
+	require.NoError(t, err)
+	require.Equal(t, []any{"x", "w"}, (*item)["tags"])
+
+	keys, err = ds.UpdateFields(ctx, "missing", Increment("count", 1))
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
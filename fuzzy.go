@@ -0,0 +1,201 @@
+package cloudypg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// Similarity condition types, added with Similar and WordSimilar. They need
+// the pg_trgm extension.
+const (
+	SimilarConditionType     = "similar"
+	WordSimilarConditionType = "wordsimilar"
+)
+
+// WithTrigram makes Open create the pg_trgm extension, which the similarity
+// conditions need, and a trigram index on each of the fields. Creating the
+// extension needs the CREATE privilege on the database when it is not already
+// installed.
+func WithTrigram(fields ...string) JsonDataStoreOption {
+	return func(opts *jsonDataStoreOptions) {
+		opts.trigram = true
+		for _, f := range fields {
+			opts.indexes = append(opts.indexes, Index{Fields: []string{f}, Trigram: true})
+		}
+	}
+}
+
+// Similar adds a condition matching the documents where the trigram
+// similarity of the field and the value is at least the threshold, between 0
+// and 1. With a threshold of 0 the pg_trgm.similarity_threshold setting of the
+// database is used (0.3 by default), which is the form a trigram index on the
+// field can speed up.
+func Similar(cg *datastore.SimpleQueryConditionGroup, field string, value string, threshold float64) {
+	addSimilar(cg, SimilarConditionType, field, value, threshold)
+}
+
+// WordSimilar is like Similar but compares the value with the most similar
+// part of the field rather than the whole of it, which suits matching a name
+// within a longer text. With a threshold of 0 the
+// pg_trgm.word_similarity_threshold setting is used (0.6 by default).
+func WordSimilar(cg *datastore.SimpleQueryConditionGroup, field string, value string, threshold float64) {
+	addSimilar(cg, WordSimilarConditionType, field, value, threshold)
+}
+
+func addSimilar(cg *datastore.SimpleQueryConditionGroup, typ string, field string, value string, threshold float64) {
+	c := &datastore.SimpleQueryCondition{Type: typ}
+	c.Data = []string{field}
+	c.Set("value", value)
+	c.Set("threshold", threshold)
+	cg.Conditions = append(cg.Conditions, c)
+}
+
+// Similarity is the fuzzy match run by SearchSimilar
+type Similarity struct {
+	Field string
+	Value string
+
+	// Word compares the value with the most similar part of the field
+	Word bool
+
+	// Threshold is the lowest score returned, the database setting when 0
+	Threshold float64
+}
+
+// SimilarResult is a document found by SearchSimilar with its similarity score
+type SimilarResult[T any] struct {
+	Key   string
+	Item  *T
+	Score float64
+}
+
+// similarityScore returns the score expression of the field and value
+func (qc *PgQueryConverter) similarityScore(word bool, field string, value string) string {
+	if word {
+		return fmt.Sprintf("word_similarity(%v, (%v))", value, field)
+	}
+	return fmt.Sprintf("similarity((%v), %v)", field, value)
+}
+
+// similarityMatch returns the condition for the field and value. The operator
+// form is used without a threshold so a trigram index can be used.
+func (qc *PgQueryConverter) similarityMatch(word bool, field string, value string, threshold float64) string {
+	switch {
+	case threshold > 0:
+		return fmt.Sprintf("%v >= %v", qc.similarityScore(word, field, value), qc.arg(threshold))
+	case word:
+		return fmt.Sprintf("%v <%% (%v)", value, field)
+	default:
+		return fmt.Sprintf("(%v) %% %v", field, value)
+	}
+}
+
+func (qc *PgQueryConverter) convertSimilar(c *datastore.SimpleQueryCondition) string {
+	if len(c.Data) != 1 {
+		return qc.fail("%v condition needs a single field", c.Type)
+	}
+	value, ok := c.DataMap["value"].(string)
+	if !ok {
+		return qc.fail("%v condition on %v needs a value", c.Type, c.Data[0])
+	}
+	threshold, _ := c.DataMap["threshold"].(float64)
+	if threshold < 0 || threshold > 1 {
+		return qc.fail("%v threshold %v is not between 0 and 1", c.Type, threshold)
+	}
+	word := c.Type == WordSimilarConditionType
+	return qc.similarityMatch(word, qc.toField(c.Data[0]), qc.arg(value), threshold)
+}
+
+// ConvertSimilarWithArgs converts the query and similarity match into a SELECT
+// of the id, data and score of the matching rows, the most similar first
+func (qc *PgQueryConverter) ConvertSimilarWithArgs(q *datastore.SimpleQuery, table string, sim *Similarity) (string, []any) {
+	qc.reset()
+
+	if sim.Threshold < 0 || sim.Threshold > 1 {
+		qc.fail("similarity threshold %v is not between 0 and 1", sim.Threshold)
+	}
+
+	field := qc.toField(sim.Field)
+	value := qc.arg(sim.Value)
+	sql := fmt.Sprintf("SELECT id, data, %v AS score FROM %s", qc.similarityScore(sim.Word, field, value), table)
+
+	where := []string{qc.similarityMatch(sim.Word, field, value, sim.Threshold)}
+	if cond := qc.convertWhere(q.Conditions); cond != "" {
+		where = append(where, "( "+cond+" )")
+	}
+	sql += " WHERE " + strings.Join(where, " AND ")
+
+	sorts := []string{"score DESC"}
+	if sort := qc.ConvertSort(q.SortBy); sort != "" {
+		sorts = append(sorts, sort)
+	}
+	sql += " ORDER BY " + strings.Join(sorts, ", ")
+	if q.Size > 0 {
+		sql += fmt.Sprintf(" LIMIT %v", q.Size)
+	}
+	if q.Offset > 0 {
+		sql += fmt.Sprintf(" OFFSET %v", q.Offset)
+	}
+	return sql, qc.args
+}
+
+// SearchSimilar finds the documents with a field similar to the value, along
+// with the conditions and paging of the query. Results are ordered by their
+// score, most similar first, and then by the query sort. Recursive queries
+// are not supported.
+func (ds *JsonDataStore[T]) SearchSimilar(ctx context.Context, query *datastore.SimpleQuery, sim *Similarity) ([]*SimilarResult[T], error) {
+	if sim.Field == "" {
+		return nil, errors.New("a similarity search needs a field")
+	}
+	if query == nil {
+		query = datastore.NewQuery()
+	}
+
+	qc := ds.converter()
+	sql, args := qc.ConvertSimilarWithArgs(query, ds.table, sim)
+	if err := qc.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, ds.wrapErr("search similar", "", err)
+	}
+	rtn, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*SimilarResult[T], error) {
+		var jsonResult []byte
+		res := &SimilarResult[T]{}
+		if err := row.Scan(&res.Key, &jsonResult, &res.Score); err != nil {
+			return nil, err
+		}
+		item, err := fromByte[T](jsonResult)
+		if err != nil {
+			return nil, err
+		}
+		res.Item = item
+		return res, nil
+	})
+	if err != nil {
+		return nil, ds.wrapErr("search similar", "", err)
+	}
+	return rtn, nil
+}
+
+// createTrigram installs the pg_trgm extension when it is missing
+func (ds *JsonDataStore[T]) createTrigram(ctx context.Context, conn querier) error {
+	_, err := conn.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS pg_trgm")
+	if err != nil {
+		return ds.wrapErr("create extension", "pg_trgm", err)
+	}
+	return nil
+}
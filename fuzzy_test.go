@@ -0,0 +1,91 @@
+package cloudypg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertSimilarConditions(t *testing.T) {
+	q := datastore.NewQuery()
+	Similar(q.Conditions, "name", "jon", 0)
+	WordSimilar(q.Conditions, "bio", "smith", 0.5)
+
+	qc := new(PgQueryConverter)
+	sql, args := qc.ConvertWithArgs(q, "testitems")
+	require.NoError(t, qc.Err())
+	require.Equal(t, "SELECT data FROM testitems WHERE (data->>'name') % $1 and word_similarity($2, (data->>'bio')) >= $3", sql)
+	require.Equal(t, []any{"jon", "smith", 0.5}, args)
+
+	q = datastore.NewQuery()
+	Similar(q.Conditions, "name", "jon", 2)
+	qc.ConvertWithArgs(q, "testitems")
+	require.ErrorIs(t, qc.Err(), ErrInvalidQuery)
+
+	sql, args = qc.ConvertSimilarWithArgs(datastore.NewQuery(), "testitems", &Similarity{Field: "name", Value: "jon", Threshold: 0.2})
+	require.NoError(t, qc.Err())
+	require.Equal(t, "SELECT id, data, similarity((data->>'name'), $1) AS score FROM testitems WHERE similarity((data->>'name'), $1) >= $2 ORDER BY score DESC", sql)
+	require.Equal(t, []any{"jon", 0.2}, args)
+}
+
+func TestTrigramIndexMatchesCondition(t *testing.T) {
+	ds := NewJsonDatastore[TestItem](context.Background(), nil, "testitems", WithTrigram("name"))
+	require.True(t, ds.opts.trigram)
+
+	name, def, err := ds.indexDefinition(ds.opts.indexes[0])
+	require.NoError(t, err)
+	require.Equal(t, "testitems_name_trgm", name)
+	require.Equal(t, "USING gin ((data->>'name') gin_trgm_ops)", def)
+
+	_, _, err = ds.indexDefinition(Index{Fields: []string{"name", "parent"}, Trigram: true})
+	require.Error(t, err)
+}
+
+func TestJsonDatastoreSimilar(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems", WithTrigram("name"))
+	require.NoError(t, ds.Open(ctx, nil))
+
+	drift, err := ds.CheckIndexes(ctx)
+	require.NoError(t, err)
+	require.Empty(t, drift)
+
+	for _, item := range []*TestItem{
+		{ID: "1", Name: "Jonathan Smith"},
+		{ID: "2", Name: "Johnathon Smyth"},
+		{ID: "3", Name: "Maria Garcia"},
+	} {
+		require.NoError(t, ds.Save(ctx, item, item.ID))
+	}
+
+	t.Run("Condition", func(t *testing.T) {
+		q := datastore.NewQuery()
+		Similar(q.Conditions, "name", "Jonathon Smith", 0)
+		found, err := ds.Query(ctx, q)
+		require.NoError(t, err)
+		require.Len(t, found, 2)
+
+		q = datastore.NewQuery()
+		WordSimilar(q.Conditions, "name", "garcia", 0.8)
+		found, err = ds.Query(ctx, q)
+		require.NoError(t, err)
+		require.Len(t, found, 1)
+		require.Equal(t, "3", found[0].ID)
+	})
+
+	t.Run("Ordered By Score", func(t *testing.T) {
+		results, err := ds.SearchSimilar(ctx, nil, &Similarity{Field: "name", Value: "Johnathon Smith", Threshold: 0.1})
+		require.NoError(t, err)
+		require.Len(t, results, 2)
+		require.Equal(t, "2", results[0].Key)
+		require.GreaterOrEqual(t, results[0].Score, results[1].Score)
+	})
+}
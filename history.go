@@ -0,0 +1,219 @@
+package cloudypg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	historySuffix   = "_history"
+	historyFnSuffix = "_history_fn"
+)
+
+// Revision operations recorded in the history table
+const (
+	RevisionInsert = "insert"
+	RevisionUpdate = "update"
+	RevisionDelete = "delete"
+
+	// RevisionRestore is a soft deleted or expired document brought back
+	RevisionRestore = "restore"
+)
+
+// ErrHistoryNotEnabled is returned by the history calls when the datastore was
+// not created with WithHistory
+var ErrHistoryNotEnabled = errors.New("history is not enabled for this datastore")
+
+// WithHistory records every revision of every document in a companion table
+// named after the datastore table with a "_history" suffix. The revisions are
+// written by a trigger so every write path is covered, and deletes are kept as
+// tombstones holding the last document so it can be restored. With soft delete
+// marking a document deleted is recorded as a delete and bringing it back as a
+// restore.
+func WithHistory() JsonDataStoreOption {
+	return func(opts *jsonDataStoreOptions) {
+		opts.history = true
+	}
+}
+
+// Revision is a single recorded change to a document. For a delete the Item is
+// the document as it was when it was deleted.
+type Revision[T any] struct {
+	Revision  int64
+	Key       string
+	Version   int64
+	Operation string
+	Timestamp time.Time
+	Item      *T
+}
+
+var createHistorySql = `
+CREATE TABLE IF NOT EXISTS $HISTORY$ (
+    revision BIGSERIAL PRIMARY KEY,
+    id VARCHAR(200) NOT NULL,
+    version INTEGER,
+    operation VARCHAR(10) NOT NULL,
+    recorded_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    data JSONB
+);
+
+CREATE INDEX IF NOT EXISTS $HISTORYINDEX$ ON $HISTORY$ (id, revision);
+
+CREATE OR REPLACE FUNCTION $HISTORYFN$() RETURNS trigger AS $cloudypg$
+DECLARE
+    op TEXT := lower(TG_OP);
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO $HISTORY$ (id, version, operation, data)
+        VALUES (OLD.id, OLD.version, 'delete', OLD.data);
+        RETURN OLD;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN
+        op := 'delete';
+    ELSIF TG_OP = 'UPDATE' AND OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NULL THEN
+        op := 'restore';
+    END IF;
+    INSERT INTO $HISTORY$ (id, version, operation, data)
+    VALUES (NEW.id, NEW.version, op, NEW.data);
+    RETURN NEW;
+END;
+$cloudypg$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS $HISTORYTRIGGER$ ON $TABLE$;
+CREATE TRIGGER $HISTORYTRIGGER$ AFTER INSERT OR UPDATE OF data, deleted_at OR DELETE ON $TABLE$
+    FOR EACH ROW EXECUTE FUNCTION $HISTORYFN$();
+`
+
+func (ds *JsonDataStore[T]) historyTable() string {
+	name, _ := ds.tableName.WithSuffix(historySuffix)
+	return name.Sanitize()
+}
+
+func (ds *JsonDataStore[T]) createHistory(ctx context.Context, conn querier) error {
+	fn, _ := ds.tableName.WithSuffix(historyFnSuffix)
+
+	sql := strings.ReplaceAll(createHistorySql, "$HISTORYFN$", fn.Sanitize())
+	sql = strings.ReplaceAll(sql, "$HISTORYINDEX$", QuoteIdentifier(ds.tableName.Name+historySuffix+"_id"))
+	sql = strings.ReplaceAll(sql, "$HISTORYTRIGGER$", QuoteIdentifier(ds.tableName.Name+historySuffix))
+	sql = strings.ReplaceAll(sql, "$HISTORY$", ds.historyTable())
+	sql = ds.tableSql(sql)
+
+	_, err := conn.Exec(ctx, sql)
+	if err != nil {
+		return ds.wrapErr("create history", "", err)
+	}
+	return nil
+}
+
+func (ds *JsonDataStore[T]) scanRevision(row pgx.Row) (*Revision[T], error) {
+	var jsonResult []byte
+	var version *int64
+	rev := &Revision[T]{}
+	err := row.Scan(&rev.Revision, &rev.Key, &version, &rev.Operation, &rev.Timestamp, &jsonResult)
+	if err != nil {
+		return nil, err
+	}
+	if version != nil {
+		rev.Version = *version
+	}
+	if jsonResult != nil {
+		rev.Item, err = fromByte[T](jsonResult)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rev, nil
+}
+
+// getRevision returns the first revision matching the where clause or nil
+func (ds *JsonDataStore[T]) getRevision(ctx context.Context, where string, args ...any) (*Revision[T], error) {
+	if !ds.opts.history {
+		return nil, ErrHistoryNotEnabled
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	sql := fmt.Sprintf(`SELECT revision, id, version, operation, recorded_at, data FROM %v
+		WHERE %v ORDER BY revision DESC LIMIT 1`, ds.historyTable(), where)
+	rev, err := ds.scanRevision(conn.QueryRow(ctx, sql, args...))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, ds.wrapErr("get revision", "", err)
+	}
+	return rev, nil
+}
+
+// ListRevisions returns every recorded revision of a document, oldest first
+func (ds *JsonDataStore[T]) ListRevisions(ctx context.Context, key string) ([]*Revision[T], error) {
+	if !ds.opts.history {
+		return nil, ErrHistoryNotEnabled
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	sql := fmt.Sprintf(`SELECT revision, id, version, operation, recorded_at, data FROM %v
+		WHERE id = $1 ORDER BY revision`, ds.historyTable())
+	rows, err := conn.Query(ctx, sql, key)
+	if err != nil {
+		return nil, ds.wrapErr("list revisions", key, err)
+	}
+	revs, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Revision[T], error) {
+		return ds.scanRevision(row)
+	})
+	if err != nil {
+		return nil, ds.wrapErr("list revisions", key, err)
+	}
+	return revs, nil
+}
+
+// GetVersion returns the document as it was at the given version, or nil when
+// that version was never recorded
+func (ds *JsonDataStore[T]) GetVersion(ctx context.Context, key string, version int64) (*T, error) {
+	rev, err := ds.getRevision(ctx, "id = $1 AND version = $2 AND operation <> 'delete'", key, version)
+	if err != nil || rev == nil {
+		return nil, err
+	}
+	return rev.Item, nil
+}
+
+// GetAsOf returns the document as it was at a point in time. Nil is returned
+// when the document did not exist yet or had been deleted at that time.
+func (ds *JsonDataStore[T]) GetAsOf(ctx context.Context, key string, at time.Time) (*T, error) {
+	rev, err := ds.getRevision(ctx, "id = $1 AND recorded_at <= $2", key, at)
+	if err != nil || rev == nil {
+		return nil, err
+	}
+	if rev.Operation == RevisionDelete {
+		return nil, nil
+	}
+	return rev.Item, nil
+}
+
+// RestoreRevision saves the document recorded in a revision as the current
+// document. Restoring a delete tombstone brings back the deleted document. The
+// restore is itself recorded as a new revision.
+func (ds *JsonDataStore[T]) RestoreRevision(ctx context.Context, key string, revision int64) error {
+	rev, err := ds.getRevision(ctx, "id = $1 AND revision = $2", key, revision)
+	if err != nil {
+		return err
+	}
+	if rev == nil || rev.Item == nil {
+		return notFoundError("restore revision", ds.table, fmt.Sprintf("%v@%v", key, revision))
+	}
+	return ds.Save(ctx, rev.Item, key)
+}
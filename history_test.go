@@ -0,0 +1,102 @@
+package cloudypg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJsonDatastoreHistory(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems", WithHistory())
+	require.NoError(t, ds.Open(ctx, nil))
+	// Opening again must not fail on the existing trigger
+	require.NoError(t, ds.Open(ctx, nil))
+
+	item := &TestItem{ID: "1", Name: "First"}
+	require.NoError(t, ds.Save(ctx, item, item.ID))
+
+	time.Sleep(50 * time.Millisecond)
+	afterFirst := time.Now()
+	time.Sleep(50 * time.Millisecond)
+
+	item.Name = "Second"
+	require.NoError(t, ds.Save(ctx, item, item.ID))
+	require.NoError(t, ds.Delete(ctx, item.ID))
+
+	revs, err := ds.ListRevisions(ctx, item.ID)
+	require.NoError(t, err)
+	require.Len(t, revs, 3)
+	require.Equal(t, RevisionInsert, revs[0].Operation)
+	require.Equal(t, RevisionUpdate, revs[1].Operation)
+	require.Equal(t, int64(2), revs[1].Version)
+	require.Equal(t, RevisionDelete, revs[2].Operation)
+	require.Equal(t, "Second", revs[2].Item.Name)
+
+	v1, err := ds.GetVersion(ctx, item.ID, 1)
+	require.NoError(t, err)
+	require.Equal(t, "First", v1.Name)
+
+	asOf, err := ds.GetAsOf(ctx, item.ID, afterFirst)
+	require.NoError(t, err)
+	require.Equal(t, "First", asOf.Name)
+
+	gone, err := ds.GetAsOf(ctx, item.ID, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Nil(t, gone)
+
+	// Bring the deleted document back from its tombstone
+	require.NoError(t, ds.RestoreRevision(ctx, item.ID, revs[2].Revision))
+	restored, err := ds.Get(ctx, item.ID)
+	require.NoError(t, err)
+	require.Equal(t, "Second", restored.Name)
+
+	plain := NewJsonDatastore[TestItem](ctx, p, "testitems")
+	_, err = plain.ListRevisions(ctx, item.ID)
+	require.ErrorIs(t, err, ErrHistoryNotEnabled)
+}
+
+func TestJsonDatastoreHistorySoftDelete(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems", WithHistory(), WithSoftDelete())
+	require.NoError(t, ds.Open(ctx, nil))
+
+	item := &TestItem{ID: "1", Name: "First"}
+	require.NoError(t, ds.Save(ctx, item, item.ID))
+	require.NoError(t, ds.Delete(ctx, item.ID))
+
+	gone, err := ds.GetAsOf(ctx, item.ID, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Nil(t, gone)
+
+	_, err = ds.Restore(ctx, item.ID)
+	require.NoError(t, err)
+
+	revs, err := ds.ListRevisions(ctx, item.ID)
+	require.NoError(t, err)
+	require.Len(t, revs, 3)
+	require.Equal(t, RevisionDelete, revs[1].Operation)
+	require.Equal(t, "First", revs[1].Item.Name)
+	require.Equal(t, RevisionRestore, revs[2].Operation)
+
+	// A soft deleted key does not exist for SaveIfVersion either
+	require.NoError(t, ds.Delete(ctx, item.ID))
+	version, err := ds.SaveIfVersion(ctx, &TestItem{ID: "1", Name: "Again"}, item.ID, 0)
+	require.NoError(t, err)
+	require.Greater(t, version, int64(1))
+
+	_, err = ds.SaveIfVersion(ctx, item, item.ID, 0)
+	require.ErrorIs(t, err, ErrVersionConflict)
+}
@@ -0,0 +1,183 @@
+package cloudypg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrInvalidIdentifier is returned when a table or column name can not be
+// safely used in SQL
+var ErrInvalidIdentifier = errors.New("invalid identifier")
+
+// maxIdentifierLength is the longest identifier PostgreSQL keeps without
+// truncating (NAMEDATALEN - 1)
+const maxIdentifierLength = 63
+
+// TableName is a parsed, optionally schema qualified, table name. The parts
+// hold the names as PostgreSQL stores them, so unquoted names are already
+// folded to lower case.
+type TableName struct {
+	Schema string
+	Name   string
+}
+
+// ParseTableName parses a table name the same way PostgreSQL would. Unquoted
+// parts are folded to lower case and must be plain identifiers, while parts
+// wrapped in double quotes keep their case and may contain any character
+// other than a NUL or a dollar sign. A single dot separates the schema from
+// the table, e.g. `app.items` or `"App"."MyItems"`.
+func ParseTableName(name string) (*TableName, error) {
+	parts, err := splitIdentifier(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: table name %q, %v", ErrInvalidIdentifier, name, err)
+	}
+
+	switch len(parts) {
+	case 1:
+		return &TableName{Name: parts[0]}, nil
+	case 2:
+		return &TableName{Schema: parts[0], Name: parts[1]}, nil
+	}
+	return nil, fmt.Errorf("%w: table name %q, expected [schema.]table", ErrInvalidIdentifier, name)
+}
+
+// Sanitize returns the table name quoted for use in a SQL statement
+func (tn *TableName) Sanitize() string {
+	if tn.Schema == "" {
+		return pgx.Identifier{tn.Name}.Sanitize()
+	}
+	return pgx.Identifier{tn.Schema, tn.Name}.Sanitize()
+}
+
+// SchemaLiteral returns the schema as a SQL literal, falling back to the
+// current schema when the name was not qualified. This is used when looking
+// the table up in the information_schema.
+func (tn *TableName) SchemaLiteral() string {
+	if tn.Schema == "" {
+		return "current_schema()"
+	}
+	return QuoteLiteral(tn.Schema)
+}
+
+// NameLiteral returns the table name (without the schema) as a SQL literal
+func (tn *TableName) NameLiteral() string {
+	return QuoteLiteral(tn.Name)
+}
+
+// WithSuffix returns a name in the same schema with the suffix appended, such
+// as the name of a companion table
+func (tn *TableName) WithSuffix(suffix string) (*TableName, error) {
+	name := tn.Name + suffix
+	if len(name) > maxIdentifierLength {
+		return nil, fmt.Errorf("%w: %q is longer than %v characters", ErrInvalidIdentifier, name, maxIdentifierLength)
+	}
+	return &TableName{Schema: tn.Schema, Name: name}, nil
+}
+
+func (tn *TableName) String() string {
+	return tn.Sanitize()
+}
+
+// QuoteIdentifier quotes a single identifier, such as a column alias, for use
+// in a SQL statement
+func QuoteIdentifier(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
+
+// QuoteLiteral quotes a string as a SQL literal. This should only be used where
+// a parameter is not allowed, such as JSON path segments that need to match an
+// index expression or statements inside a DO block.
+func QuoteLiteral(value string) string {
+	value = strings.ReplaceAll(value, "\x00", "")
+	if strings.Contains(value, `\`) {
+		return `E'` + strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), "'", "''") + "'"
+	}
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// splitIdentifier splits a dotted name into its parts following the
+// PostgreSQL rules for quoted and unquoted identifiers
+func splitIdentifier(name string) ([]string, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, errors.New("name is empty")
+	}
+
+	var parts []string
+	rest := name
+	for {
+		var part string
+		if strings.HasPrefix(rest, `"`) {
+			// Quoted identifier, "" is an escaped quote
+			var sb strings.Builder
+			i := 1
+			closed := false
+			for i < len(rest) {
+				if rest[i] == '"' {
+					if i+1 < len(rest) && rest[i+1] == '"' {
+						sb.WriteByte('"')
+						i += 2
+						continue
+					}
+					closed = true
+					i++
+					break
+				}
+				sb.WriteByte(rest[i])
+				i++
+			}
+			if !closed {
+				return nil, errors.New("unterminated quoted identifier")
+			}
+			part = sb.String()
+			rest = rest[i:]
+		} else {
+			end := strings.IndexByte(rest, '.')
+			if end < 0 {
+				end = len(rest)
+			}
+			part = rest[:end]
+			rest = rest[end:]
+			if !isPlainIdentifier(part) {
+				return nil, fmt.Errorf("%q must be quoted or contain only letters, digits and underscores", part)
+			}
+			part = strings.ToLower(part)
+		}
+
+		if part == "" {
+			return nil, errors.New("empty identifier")
+		}
+		if len(part) > maxIdentifierLength {
+			return nil, fmt.Errorf("%q is longer than %v characters", part, maxIdentifierLength)
+		}
+		if strings.ContainsAny(part, "\x00$") {
+			return nil, fmt.Errorf("%q contains a NUL or dollar sign", part)
+		}
+		parts = append(parts, part)
+
+		if rest == "" {
+			return parts, nil
+		}
+		if rest[0] != '.' {
+			return nil, fmt.Errorf("unexpected %q after identifier", rest)
+		}
+		rest = rest[1:]
+	}
+}
+
+func isPlainIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && r >= '0' && r <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
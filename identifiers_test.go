@@ -0,0 +1,74 @@
+package cloudypg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTableName(t *testing.T) {
+	tests := []struct {
+		in       string
+		schema   string
+		name     string
+		sanitize string
+	}{
+		{"testitems", "", "testitems", `"testitems"`},
+		{"TestItems", "", "testitems", `"testitems"`},
+		{`"TestItems"`, "", "TestItems", `"TestItems"`},
+		{"app.items", "app", "items", `"app"."items"`},
+		{`"My App"."Items"`, "My App", "Items", `"My App"."Items"`},
+		{`"a""b"`, "", `a"b`, `"a""b"`},
+		{`"a.b"`, "", "a.b", `"a.b"`},
+	}
+	for _, tt := range tests {
+		tn, err := ParseTableName(tt.in)
+		require.NoError(t, err, tt.in)
+		require.Equal(t, tt.schema, tn.Schema, tt.in)
+		require.Equal(t, tt.name, tn.Name, tt.in)
+		require.Equal(t, tt.sanitize, tn.Sanitize(), tt.in)
+	}
+
+	invalid := []string{
+		"",
+		"test-items",
+		"items; DROP TABLE users",
+		"a.b.c",
+		"app.",
+		`"unterminated`,
+		`"a$$b"`,
+		"1items",
+		"abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyzabcdefghijklm",
+	}
+	for _, in := range invalid {
+		_, err := ParseTableName(in)
+		require.ErrorIs(t, err, ErrInvalidIdentifier, in)
+	}
+}
+
+func TestNewJsonDatastoreChecked(t *testing.T) {
+	ds, err := NewJsonDatastoreChecked[TestItem](context.Background(), nil, "items; DROP TABLE testitems")
+	require.ErrorIs(t, err, ErrInvalidIdentifier)
+	require.Nil(t, ds)
+
+	_, err = NewJsonDatastoreChecked[TestItem](context.Background(), nil, "abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyzabcdefghij", WithHistory())
+	require.ErrorIs(t, err, ErrInvalidIdentifier)
+
+	ds, err = NewJsonDatastoreChecked[TestItem](context.Background(), nil, "myapp.items")
+	require.NoError(t, err)
+	require.Equal(t, `"myapp"."items"`, ds.table)
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	require.Equal(t, "'abc'", QuoteLiteral("abc"))
+	require.Equal(t, "'it''s'", QuoteLiteral("it's"))
+	require.Equal(t, `E'a\\b'`, QuoteLiteral(`a\b`))
+}
+
+func TestConvertEscapesJsonPath(t *testing.T) {
+	q := &PgQueryConverter{}
+	require.Equal(t, "data->'a'->>'b''c'", q.toField("a.b'c"))
+	require.Equal(t, "data->'a'->'b'", q.toJsonField("a.b"))
+	require.Equal(t, "data->>'name'", q.toField("name"))
+}
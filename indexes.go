@@ -0,0 +1,287 @@
+package cloudypg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/appliedres/cloudy/logging"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// indexMarker prefixes the comment on every index managed by the datastore so
+// they can be told apart from indexes created by hand
+const indexMarker = "cloudypg:"
+
+// Index drift reasons reported by CheckIndexes
+const (
+	// IndexUndeclared is a managed index that is no longer declared
+	IndexUndeclared = "undeclared"
+	// IndexChanged is a declared index that exists with a different definition
+	IndexChanged = "changed"
+)
+
+// Index declares an index on the JSON document. A btree index (the default) is
+// an expression index on the text value of each field, matching the SQL
+// generated for SimpleQuery conditions and sorts on those fields. A GIN index
+// on a single field is used by the contains, in and anyin conditions on that
+// field. Without a field the GIN index covers the whole document, which only
+// helps hand written containment queries on the data column since the
+// generated conditions always work on a field. A search index is a GIN
+// index on the text search vector of the fields, used by SearchText conditions
+// and Search with the same fields and language. A trigram index is a GIN index
+// on the text value of a single field, used by Similar and WordSimilar
+// conditions and needs the pg_trgm extension (see WithTrigram). Fields are
+// dotted paths as used in SimpleQuery.
+type Index struct {
+	// Name of the index, generated from the table and fields when empty
+	Name    string
+	Fields  []string
+	Gin     bool
+	Unique  bool
+	Search  bool
+	Trigram bool
+
+	// Language of a search index, DefaultSearchLanguage when empty
+	Language string
+}
+
+// IndexDrift describes a difference between the declared indexes and the
+// indexes in the database
+type IndexDrift struct {
+	Name   string
+	Reason string
+}
+
+// WithIndexes declares the indexes Open makes sure exist. Indexes are created
+// concurrently when possible so writes are not blocked. Managed indexes that
+// are no longer declared are reported but never dropped.
+func WithIndexes(indexes ...Index) JsonDataStoreOption {
+	return func(opts *jsonDataStoreOptions) {
+		opts.indexes = append(opts.indexes, indexes...)
+		for _, idx := range indexes {
+			opts.trigram = opts.trigram || idx.Trigram
+		}
+	}
+}
+
+// indexDefinition returns the name and the USING and expression part of the
+// CREATE INDEX statement for the declared index
+func (ds *JsonDataStore[T]) indexDefinition(idx Index) (string, string, error) {
+	qc := ds.converter()
+
+	var def string
+	switch {
+	case idx.Trigram && (idx.Gin || idx.Unique || idx.Search):
+		return "", "", errors.New("a trigram index can not also be a GIN, unique or search index")
+	case idx.Trigram && len(idx.Fields) != 1:
+		return "", "", errors.New("a trigram index must be on a single field")
+	case idx.Trigram:
+		def = fmt.Sprintf("USING gin ((%v) gin_trgm_ops)", qc.toField(idx.Fields[0]))
+	case idx.Search && (idx.Gin || idx.Unique):
+		return "", "", errors.New("a search index can not also be a GIN or unique index")
+	case idx.Search && len(idx.Fields) == 0:
+		return "", "", errors.New("a search index needs at least one field")
+	case idx.Search:
+		def = fmt.Sprintf("USING gin ((%v))", qc.toTsvector(idx.Language, idx.Fields))
+	case idx.Gin && idx.Unique:
+		return "", "", errors.New("a GIN index can not be unique")
+	case idx.Gin && len(idx.Fields) > 1:
+		return "", "", errors.New("a GIN index can only be on a single field")
+	case idx.Gin && len(idx.Fields) == 0:
+		def = fmt.Sprintf("USING gin ((%v))", qc.asJsonb("data"))
+	case idx.Gin:
+		def = fmt.Sprintf("USING gin ((%v))", qc.asJsonb(qc.toJsonField(idx.Fields[0])))
+	case len(idx.Fields) == 0:
+		return "", "", errors.New("a btree index needs at least one field")
+	default:
+		exprs := make([]string, len(idx.Fields))
+		for i, f := range idx.Fields {
+			exprs[i] = fmt.Sprintf("(%v)", qc.toField(f))
+		}
+		def = fmt.Sprintf("USING btree (%v)", strings.Join(exprs, ", "))
+	}
+
+	name := idx.Name
+	if name == "" {
+		name = ds.indexName(idx)
+	}
+	if len(name) > maxIdentifierLength {
+		return "", "", fmt.Errorf("%w: index name %v is longer than %v characters", ErrInvalidIdentifier, name, maxIdentifierLength)
+	}
+	return name, def, nil
+}
+
+// indexName generates the name of an index as <table>_<fields>_idx, or _gin for
+// GIN indexes. Long names are shortened with a hash to stay unique.
+func (ds *JsonDataStore[T]) indexName(idx Index) string {
+	parts := []string{ds.tableName.Name}
+	for _, f := range idx.Fields {
+		parts = append(parts, strings.Map(func(r rune) rune {
+			if r == '.' || r == ' ' {
+				return '_'
+			}
+			return r
+		}, f))
+	}
+	switch {
+	case idx.Search:
+		parts = append(parts, "fts")
+	case idx.Trigram:
+		parts = append(parts, "trgm")
+	case idx.Gin && len(idx.Fields) == 0:
+		parts = append(parts, "data_gin")
+	case idx.Gin:
+		parts = append(parts, "gin")
+	case idx.Unique:
+		parts = append(parts, "key")
+	default:
+		parts = append(parts, "idx")
+	}
+	return shortenIdentifier(strings.Join(parts, "_"))
+}
+
+// shortenIdentifier cuts names longer than PostgreSQL allows, ending them with
+// a hash of the full name so they stay unique
+func shortenIdentifier(name string) string {
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	suffix := fmt.Sprintf("_%08x", h.Sum32())
+	return name[:maxIdentifierLength-len(suffix)] + suffix
+}
+
+// indexState is an index found on the table
+type indexState struct {
+	valid   bool
+	comment string
+}
+
+func (ds *JsonDataStore[T]) loadIndexes(ctx context.Context, conn querier) (map[string]indexState, error) {
+	rows, err := conn.Query(ctx, `SELECT c.relname, ix.indisvalid, COALESCE(obj_description(c.oid, 'pg_class'), '')
+		FROM pg_index ix JOIN pg_class c ON c.oid = ix.indexrelid
+		WHERE ix.indrelid = $1::regclass`, ds.table)
+	if err != nil {
+		return nil, ds.wrapErr("read indexes", "", err)
+	}
+	defer rows.Close()
+
+	found := make(map[string]indexState)
+	for rows.Next() {
+		var name string
+		var state indexState
+		if err = rows.Scan(&name, &state.valid, &state.comment); err != nil {
+			return nil, ds.wrapErr("read indexes", "", err)
+		}
+		found[name] = state
+	}
+	if err = rows.Err(); err != nil {
+		return nil, ds.wrapErr("read indexes", "", err)
+	}
+	return found, nil
+}
+
+// execConcurrently runs the CONCURRENTLY form of an index statement, or the
+// plain form when the connection is inside a transaction. CONCURRENTLY fails in
+// a transaction block and aborts it, so the choice is made up front.
+func execConcurrently(ctx context.Context, conn querier, concurrentSql string, plainSql string) error {
+	sql := concurrentSql
+	if inTransaction(conn) {
+		sql = plainSql
+	}
+	_, err := conn.Exec(ctx, sql)
+	return err
+}
+
+// inTransaction reports whether statements on the connection run inside a
+// transaction block, either a pgx.Tx or one begun by hand on a pooled
+// connection
+func inTransaction(conn querier) bool {
+	switch c := conn.(type) {
+	case pgx.Tx:
+		return true
+	case *pgxpool.Conn:
+		return c.Conn().PgConn().TxStatus() != 'I'
+	}
+	return false
+}
+
+// ensureIndexes creates the declared indexes that are missing, rebuilds any
+// left invalid by an interrupted concurrent build and returns the drift
+func (ds *JsonDataStore[T]) ensureIndexes(ctx context.Context, conn querier) ([]IndexDrift, error) {
+	found, err := ds.loadIndexes(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var drift []IndexDrift
+	declared := make(map[string]bool)
+	for _, idx := range ds.opts.indexes {
+		name, def, err := ds.indexDefinition(idx)
+		if err != nil {
+			return nil, err
+		}
+		declared[name] = true
+
+		unique := ""
+		if idx.Unique {
+			unique = "UNIQUE "
+		}
+		marker := indexMarker + unique + def
+
+		state, exists := found[name]
+		if exists && state.valid {
+			if state.comment != marker {
+				drift = append(drift, IndexDrift{Name: name, Reason: IndexChanged})
+			}
+			continue
+		}
+
+		qualified := (&TableName{Schema: ds.tableName.Schema, Name: name}).Sanitize()
+		if exists {
+			err = execConcurrently(ctx, conn, "DROP INDEX CONCURRENTLY IF EXISTS "+qualified, "DROP INDEX IF EXISTS "+qualified)
+			if err != nil {
+				return nil, ds.wrapErr("drop index", name, err)
+			}
+		}
+
+		create := fmt.Sprintf("IF NOT EXISTS %v ON %v %v", QuoteIdentifier(name), ds.table, def)
+		err = execConcurrently(ctx, conn, "CREATE "+unique+"INDEX CONCURRENTLY "+create, "CREATE "+unique+"INDEX "+create)
+		if err != nil {
+			return nil, ds.wrapErr("create index", name, err)
+		}
+		_, err = conn.Exec(ctx, fmt.Sprintf("COMMENT ON INDEX %v IS %v", qualified, QuoteLiteral(marker)))
+		if err != nil {
+			return nil, ds.wrapErr("create index", name, err)
+		}
+		logging.GetLogger(ctx).DebugContext(ctx, fmt.Sprintf("Created index %v on %v", name, ds.table))
+	}
+
+	for name, state := range found {
+		if !declared[name] && strings.HasPrefix(state.comment, indexMarker) {
+			drift = append(drift, IndexDrift{Name: name, Reason: IndexUndeclared})
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool { return drift[i].Name < drift[j].Name })
+	return drift, nil
+}
+
+// CheckIndexes creates any declared index that is missing and returns the
+// managed indexes that differ from the declarations. Open does the same and
+// logs the drift as warnings.
+func (ds *JsonDataStore[T]) CheckIndexes(ctx context.Context) ([]IndexDrift, error) {
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	return ds.ensureIndexes(ctx, conn)
+}
@@ -0,0 +1,116 @@
+package cloudypg
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexDefinitionMatchesQuery(t *testing.T) {
+	ctx := cloudy.StartContext()
+	ds := NewJsonDatastore[datastore.TestItem](ctx, nil, "testitems")
+
+	name, def, err := ds.indexDefinition(Index{Fields: []string{"level1.value", "name"}})
+	require.NoError(t, err)
+	require.Equal(t, "testitems_level1_value_name_idx", name)
+	require.Equal(t, "USING btree ((data->'level1'->>'value'), (data->>'name'))", def)
+
+	q := datastore.NewQuery()
+	q.Conditions.Equals("level1.value", "a")
+	sql, _ := ds.converter().ConvertWithArgs(q, ds.table)
+	require.Contains(t, sql, "(data->'level1'->>'value') = $1")
+
+	name, def, err = ds.indexDefinition(Index{Fields: []string{"tags"}, Gin: true})
+	require.NoError(t, err)
+	require.Equal(t, "testitems_tags_gin", name)
+	require.Equal(t, "USING gin (((data->'tags')::jsonb))", def)
+
+	ds.jsonb.Store(true)
+	_, def, err = ds.indexDefinition(Index{Gin: true})
+	require.NoError(t, err)
+	require.Equal(t, "USING gin ((data))", def)
+
+	_, _, err = ds.indexDefinition(Index{Gin: true, Unique: true, Fields: []string{"id"}})
+	require.Error(t, err)
+	_, _, err = ds.indexDefinition(Index{})
+	require.Error(t, err)
+
+	long := ds.indexName(Index{Fields: []string{strings.Repeat("a", 80)}})
+	require.Len(t, long, maxIdentifierLength)
+}
+
+func TestJsonDatastoreIndexes(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[datastore.TestItem](ctx, p, "indexeditems",
+		WithIndexes(
+			Index{Fields: []string{"name"}},
+			Index{Fields: []string{"id"}, Unique: true},
+			Index{Gin: true},
+		))
+	err := ds.Open(ctx, nil)
+	require.NoError(t, err)
+
+	conn, err := p.Acquire(ctx)
+	require.NoError(t, err)
+	found, err := ds.loadIndexes(ctx, conn)
+	p.Return(ctx, conn)
+	require.NoError(t, err)
+	require.Contains(t, found, "indexeditems_name_idx")
+	require.Contains(t, found, "indexeditems_id_key")
+	require.Contains(t, found, "indexeditems_data_gin")
+
+	// Opening again is a no-op
+	drift, err := ds.CheckIndexes(ctx)
+	require.NoError(t, err)
+	require.Empty(t, drift)
+
+	// Unique index is enforced
+	require.NoError(t, ds.Save(ctx, &datastore.TestItem{ID: "1", Name: "a"}, "a"))
+	require.Error(t, ds.Save(ctx, &datastore.TestItem{ID: "1", Name: "b"}, "b"))
+
+	// Dropping a declaration is reported as drift
+	ds2 := NewJsonDatastore[datastore.TestItem](ctx, p, "indexeditems",
+		WithIndexes(Index{Fields: []string{"name"}}, Index{Name: "indexeditems_id_key", Fields: []string{"id", "name"}}))
+	err = ds2.Open(ctx, nil)
+	require.NoError(t, err)
+	drift, err = ds2.CheckIndexes(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []IndexDrift{
+		{Name: "indexeditems_data_gin", Reason: IndexUndeclared},
+		{Name: "indexeditems_id_key", Reason: IndexChanged},
+	}, drift)
+}
+
+func TestJsonDatastoreIndexesInTx(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[datastore.TestItem](ctx, p, "indexeditems",
+		WithIndexes(Index{Fields: []string{"name"}}))
+
+	// Inside a transaction the indexes are built without CONCURRENTLY and the
+	// transaction stays usable
+	err := RunInTx(ctx, p, func(ctx context.Context) error {
+		if err := ds.Open(ctx, nil); err != nil {
+			return err
+		}
+		return ds.Save(ctx, &datastore.TestItem{ID: "1", Name: "a"}, "1")
+	})
+	require.NoError(t, err)
+
+	drift, err := ds.CheckIndexes(ctx)
+	require.NoError(t, err)
+	require.Empty(t, drift)
+}
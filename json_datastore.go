@@ -6,29 +6,103 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync/atomic"
 
 	"github.com/appliedres/cloudy"
 	"github.com/appliedres/cloudy/datastore"
 	"github.com/appliedres/cloudy/logging"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var _ datastore.JsonDataStore[string] = (*JsonDataStore[string])(nil)
 var _ datastore.BulkJsonDataStore[string] = (*JsonDataStore[string])(nil)
 
+// querier is the part of pgxpool.Conn and pgx.Tx used to run statements, so the
+// same code can run with or without a transaction
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// JsonDataStoreOption turns on optional behaviour of a JsonDataStore
+type JsonDataStoreOption func(opts *jsonDataStoreOptions)
+
+type jsonDataStoreOptions struct {
+	history       bool
+	softDelete    bool
+	expiry        bool
+	changeFeed    bool
+	trigram       bool
+	indexes       []Index
+	keyFn         any
+	bulkThreshold int
+}
+
 type JsonDataStore[T any] struct {
 	provider      PostgresqlConnectionProvider
 	table         string
+	tableName     *TableName
+	tableErr      error
+	opts          jsonDataStoreOptions
+	jsonb         atomic.Bool
 	ConnectionKey pgContextKey
 }
 
-func NewJsonDatastore[T any](ctx context.Context, provider PostgresqlConnectionProvider, table string) *JsonDataStore[T] {
-	return &JsonDataStore[T]{
+// NewJsonDatastore creates a datastore backed by the given table. The table
+// name may be schema qualified and follows the PostgreSQL quoting rules (see
+// ParseTableName). An invalid name is not reported here: it is kept in the
+// datastore and returned by Open and every other call before any SQL is sent.
+// Use NewJsonDatastoreChecked to have it reported right away.
+func NewJsonDatastore[T any](ctx context.Context, provider PostgresqlConnectionProvider, table string, opts ...JsonDataStoreOption) *JsonDataStore[T] {
+	ds, _ := newJsonDatastore[T](provider, table, opts)
+	return ds
+}
+
+// NewJsonDatastoreChecked is NewJsonDatastore returning the error for an
+// invalid table name instead of keeping it for Open
+func NewJsonDatastoreChecked[T any](ctx context.Context, provider PostgresqlConnectionProvider, table string, opts ...JsonDataStoreOption) (*JsonDataStore[T], error) {
+	ds, err := newJsonDatastore[T](provider, table, opts)
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// newJsonDatastore builds the datastore and returns the table name error it
+// keeps, if any
+func newJsonDatastore[T any](provider PostgresqlConnectionProvider, table string, opts []JsonDataStoreOption) (*JsonDataStore[T], error) {
+	ds := &JsonDataStore[T]{
 		provider:      provider,
 		table:         table,
 		ConnectionKey: pgContextKey(table),
 	}
+	ds.opts.bulkThreshold = DefaultBulkThreshold
+	for _, opt := range opts {
+		opt(&ds.opts)
+	}
+
+	name, err := ParseTableName(table)
+	if err != nil {
+		ds.tableErr = err
+		return ds, err
+	}
+	ds.tableName = name
+	ds.table = name.Sanitize()
+
+	if ds.opts.history {
+		if _, err = ds.tableName.WithSuffix(historyFnSuffix); err != nil {
+			ds.tableErr = err
+		}
+	}
+	if ds.opts.changeFeed {
+		if _, err = ds.tableName.WithSuffix(changesFnSuffix); err != nil {
+			ds.tableErr = err
+		}
+	}
+	return ds, ds.tableErr
 }
 
 // Open will open the datastore for usage. This should
@@ -50,29 +124,43 @@ func (ds *JsonDataStore[T]) Close(ctx context.Context) error {
 	return nil
 }
 
-func (ds *JsonDataStore[T]) returnConnection(ctx context.Context, conn *pgxpool.Conn) {
+func (ds *JsonDataStore[T]) returnConnection(ctx context.Context, conn dbConn) {
 	if conn == nil {
 		fmt.Println("RETURNING NIL CONNECTION")
 		return
 	}
 
+	// Transactions belong to RunInTx and are never returned here
+	pc, ok := conn.(*pgxpool.Conn)
+	if !ok {
+		return
+	}
+
 	// Dont get rid of the connection if it cam from the context
 	obj := ctx.Value(ds.ConnectionKey)
-	if obj != nil && obj == conn {
+	if obj != nil && obj == pc {
 		return
 	}
 
 	if ds.provider != nil {
-		ds.provider.Return(ctx, conn)
+		ds.provider.Return(ctx, pc)
 	} else {
-		conn.Release()
+		pc.Release()
 	}
 
 }
 
-func (ds *JsonDataStore[T]) checkConnection(ctx context.Context) (*pgxpool.Conn, error) {
-	var conn *pgxpool.Conn
-	var err error
+// checkConnection returns what the statements of an operation run on. That is
+// the transaction started by RunInTx for the provider, then the connection set
+// with CtxSetConnection and otherwise a connection from the provider.
+func (ds *JsonDataStore[T]) checkConnection(ctx context.Context) (dbConn, error) {
+	if ds.tableErr != nil {
+		return nil, ds.tableErr
+	}
+
+	if tx := txFromContext(ctx, ds.provider); tx != nil {
+		return tx, nil
+	}
 
 	// Check to see if there is a connection in the context. If not then add one
 	obj := ctx.Value(ds.ConnectionKey)
@@ -84,9 +172,9 @@ func (ds *JsonDataStore[T]) checkConnection(ctx context.Context) (*pgxpool.Conn,
 		return nil, errors.New("no connection provider")
 	}
 
-	conn, err = ds.provider.Acquire(ctx)
+	conn, err := ds.provider.Acquire(ctx)
 	if err != nil {
-		return nil, cloudy.Error(ctx, "Unable to aquire connection to database: %v\n", err)
+		return nil, connectionError(ds.table, err)
 	}
 
 	// Table does not exist
@@ -109,20 +197,74 @@ func (ds *JsonDataStore[T]) checkConnection(ctx context.Context) (*pgxpool.Conn,
 	return conn, nil
 }
 
-func (ds *JsonDataStore[T]) onOpen(ctx context.Context, conn *pgxpool.Conn) error {
-	sqlTableCreate := strings.ReplaceAll(createTableSql, "$TABLE$", ds.table)
+// wrapErr wraps a database error from an operation on the table
+func (ds *JsonDataStore[T]) wrapErr(op string, key string, err error) error {
+	return newError(op, ds.table, key, err)
+}
+
+func (ds *JsonDataStore[T]) onOpen(ctx context.Context, conn dbConn) error {
+	sqlTableCreate := ds.tableSql(createTableSql)
 
 	tag, err := conn.Exec(ctx, sqlTableCreate)
 	if err != nil {
-		return cloudy.Error(ctx, "Unable to create table: %v, %v\n", ds.table, err)
+		return ds.wrapErr("create table", "", err)
 	}
 	if tag.RowsAffected() > 0 {
 		logging.GetLogger(ctx).DebugContext(ctx, fmt.Sprintf("Created or modified table %v", ds.table))
 	}
 
+	isJsonb, err := ds.detectJsonb(ctx, conn)
+	if err != nil {
+		return err
+	}
+	ds.jsonb.Store(isJsonb)
+
+	if ds.opts.history {
+		if err = ds.createHistory(ctx, conn); err != nil {
+			return err
+		}
+	}
+
+	if ds.opts.changeFeed {
+		if err = ds.createChangeFeed(ctx, conn); err != nil {
+			return err
+		}
+	}
+
+	if ds.opts.expiry {
+		if err = ds.createExpiryIndex(ctx, conn); err != nil {
+			return err
+		}
+	}
+
+	if ds.opts.trigram {
+		if err = ds.createTrigram(ctx, conn); err != nil {
+			return err
+		}
+	}
+
+	if len(ds.opts.indexes) > 0 {
+		drift, err := ds.ensureIndexes(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, d := range drift {
+			logging.GetLogger(ctx).WarnContext(ctx, fmt.Sprintf("Index %v on %v is %v", d.Name, ds.table, d.Reason))
+		}
+	}
+
 	return nil
 }
 
+// tableSql fills in the table placeholders of a DDL template. $TABLE$ is the
+// quoted table name while $SCHEMA$ and $TABLENAME$ are literals used to look
+// the table up in the information_schema.
+func (ds *JsonDataStore[T]) tableSql(tmpl string) string {
+	sql := strings.ReplaceAll(tmpl, "$SCHEMA$", ds.tableName.SchemaLiteral())
+	sql = strings.ReplaceAll(sql, "$TABLENAME$", ds.tableName.NameLiteral())
+	return strings.ReplaceAll(sql, "$TABLE$", ds.table)
+}
+
 var createTableSql = `
 DO $$ 
 BEGIN
@@ -132,30 +274,55 @@ BEGIN
         version INTEGER DEFAULT 1,
         last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
         date_created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-        data JSON
+        deleted_at TIMESTAMPTZ,
+        expires_at TIMESTAMPTZ,
+        data JSONB
     );
 
     -- Ensure the table has the required columns
     IF NOT EXISTS (
         SELECT 1 FROM information_schema.columns 
-        WHERE table_name = '$TABLE$' AND column_name = 'version'
+        WHERE table_schema = $SCHEMA$ AND table_name = $TABLENAME$ AND column_name = 'version'
     ) THEN
         ALTER TABLE $TABLE$ ADD COLUMN version INTEGER DEFAULT 1;
     END IF;
 
     IF NOT EXISTS (
         SELECT 1 FROM information_schema.columns 
-        WHERE table_name = '$TABLE$' AND column_name = 'last_updated'
+        WHERE table_schema = $SCHEMA$ AND table_name = $TABLENAME$ AND column_name = 'last_updated'
     ) THEN
         ALTER TABLE $TABLE$ ADD COLUMN last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
     END IF;
 
     IF NOT EXISTS (
         SELECT 1 FROM information_schema.columns 
-        WHERE table_name = '$TABLE$' AND column_name = 'date_created'
+        WHERE table_schema = $SCHEMA$ AND table_name = $TABLENAME$ AND column_name = 'date_created'
     ) THEN
         ALTER TABLE $TABLE$ ADD COLUMN date_created TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
     END IF;
+
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns 
+        WHERE table_schema = $SCHEMA$ AND table_name = $TABLENAME$ AND column_name = 'deleted_at'
+    ) THEN
+        ALTER TABLE $TABLE$ ADD COLUMN deleted_at TIMESTAMPTZ;
+    END IF;
+
+    -- Older tables keep the soft delete time without a time zone
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns 
+        WHERE table_schema = $SCHEMA$ AND table_name = $TABLENAME$ AND column_name = 'deleted_at'
+        AND data_type = 'timestamp without time zone'
+    ) THEN
+        ALTER TABLE $TABLE$ ALTER COLUMN deleted_at TYPE TIMESTAMPTZ;
+    END IF;
+
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns 
+        WHERE table_schema = $SCHEMA$ AND table_name = $TABLENAME$ AND column_name = 'expires_at'
+    ) THEN
+        ALTER TABLE $TABLE$ ADD COLUMN expires_at TIMESTAMPTZ;
+    END IF;
 END $$;
 `
 
@@ -173,17 +340,22 @@ func (ds *JsonDataStore[T]) Save(ctx context.Context, item *T, key string) error
 		return fmt.Errorf("error converting to json, %v", err)
 	}
 
-	sqlUpsert := fmt.Sprintf(`INSERT INTO %v (id, data) VALUES ($1, $2) 
-		ON CONFLICT (id) DO UPDATE 
-		SET version =  %v.version + 1, last_updated = CURRENT_TIMESTAMP, data=$2;`, ds.table, ds.table)
-	_, err = conn.Exec(ctx, sqlUpsert, key, data)
+	_, err = conn.Exec(ctx, ds.upsertSql(), key, data)
 	if err != nil {
-		return fmt.Errorf("database error, %v", err)
+		return ds.wrapErr("save", key, err)
 	}
 
 	return nil
 }
 
+// upsertSql inserts or updates a document, bumping the version on update. A
+// soft deleted or expired document is brought back when it is saved again.
+func (ds *JsonDataStore[T]) upsertSql() string {
+	return fmt.Sprintf(`INSERT INTO %v AS t (id, data) VALUES ($1, $2) 
+		ON CONFLICT (id) DO UPDATE 
+		SET version =  t.version + 1, last_updated = CURRENT_TIMESTAMP, data=$2%v;`, ds.table, ds.reviveSet())
+}
+
 func (ds *JsonDataStore[T]) GetMetadata(ctx context.Context, key ...string) ([]*datastore.RowMetadata, error) {
 	conn, err := ds.checkConnection(ctx)
 	if err != nil {
@@ -191,10 +363,10 @@ func (ds *JsonDataStore[T]) GetMetadata(ctx context.Context, key ...string) ([]*
 	}
 	defer ds.returnConnection(ctx, conn)
 
-	sqlStmt := fmt.Sprintf(`SELECT id, version, last_updated, date_created FROM %v where ID = ANY($1)`, ds.table)
+	sqlStmt := fmt.Sprintf(`SELECT id, version, last_updated, date_created FROM %v where ID = ANY($1)%v`, ds.table, ds.andVisible())
 	rows, err := conn.Query(ctx, sqlStmt, key)
 	if err != nil {
-		return nil, cloudy.Error(ctx, "Error querying database : %v", err)
+		return nil, ds.wrapErr("get metadata", "", err)
 	}
 	defer rows.Close()
 
@@ -208,7 +380,7 @@ func (ds *JsonDataStore[T]) GetMetadata(ctx context.Context, key ...string) ([]*
 			if errors.Is(err, pgx.ErrNoRows) {
 				return nil, nil
 			}
-			return nil, fmt.Errorf("error scaning into struct : %v", err)
+			return nil, err
 		}
 		meta := &datastore.RowMetadata{
 			Key: id,
@@ -226,17 +398,22 @@ func (ds *JsonDataStore[T]) GetMetadata(ctx context.Context, key ...string) ([]*
 
 		return meta, nil
 	})
-	return rtn, err
+	if err != nil {
+		return nil, ds.wrapErr("get metadata", "", err)
+	}
+	return rtn, nil
 }
 
-// Get retrieves an item by it's unique id
+// Get retrieves an item by it's unique id. A missing key returns nil without an
+// error as the datastore.JsonDataStore contract expects, use GetExisting to get
+// ErrNotFound instead.
 func (ds *JsonDataStore[T]) Get(ctx context.Context, key string) (*T, error) {
 	conn, err := ds.checkConnection(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer ds.returnConnection(ctx, conn)
-	sql := fmt.Sprintf(`SELECT data FROM %v where ID=$1`, ds.table)
+	sql := fmt.Sprintf(`SELECT data FROM %v where ID=$1%v`, ds.table, ds.andVisible())
 	row := conn.QueryRow(ctx, sql, key)
 
 	var jsonResult []byte
@@ -246,12 +423,74 @@ func (ds *JsonDataStore[T]) Get(ctx context.Context, key string) (*T, error) {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("error scaning into struct : %v", err)
+		return nil, ds.wrapErr("get", key, err)
 	}
 
 	return fromByte[T](jsonResult)
 }
 
+// GetExisting retrieves an item by it's unique id and returns ErrNotFound when
+// it does not exist
+func (ds *JsonDataStore[T]) GetExisting(ctx context.Context, key string) (*T, error) {
+	item, err := ds.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, notFoundError("get", ds.table, key)
+	}
+	return item, nil
+}
+
+// GetMany retrieves the items with the given keys in a single query. Keys that
+// do not exist are left out of the map.
+func (ds *JsonDataStore[T]) GetMany(ctx context.Context, keys []string) (map[string]*T, error) {
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	sql := fmt.Sprintf(`SELECT id, data FROM %v WHERE ID = ANY($1)%v`, ds.table, ds.andVisible())
+	rows, err := conn.Query(ctx, sql, keys)
+	if err != nil {
+		return nil, ds.wrapErr("get many", "", err)
+	}
+	defer rows.Close()
+
+	rtn := make(map[string]*T, len(keys))
+	for rows.Next() {
+		var id string
+		var jsonResult []byte
+		if err = rows.Scan(&id, &jsonResult); err != nil {
+			return nil, ds.wrapErr("get many", "", err)
+		}
+		item, err := fromByte[T](jsonResult)
+		if err != nil {
+			return nil, err
+		}
+		rtn[id] = item
+	}
+	if err = rows.Err(); err != nil {
+		return nil, ds.wrapErr("get many", "", err)
+	}
+	return rtn, nil
+}
+
+// GetManyOrdered is GetMany returning a slice in the order of the keys, with
+// nil for each key that does not exist
+func (ds *JsonDataStore[T]) GetManyOrdered(ctx context.Context, keys []string) ([]*T, error) {
+	found, err := ds.GetMany(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	rtn := make([]*T, len(keys))
+	for i, key := range keys {
+		rtn[i] = found[key]
+	}
+	return rtn, nil
+}
+
 // Gets all the items in the store.
 func (ds *JsonDataStore[T]) GetAll(ctx context.Context) ([]*T, error) {
 	conn, err := ds.checkConnection(ctx)
@@ -260,10 +499,10 @@ func (ds *JsonDataStore[T]) GetAll(ctx context.Context) ([]*T, error) {
 	}
 	defer ds.returnConnection(ctx, conn)
 
-	sql := fmt.Sprintf(`SELECT data FROM %v`, ds.table)
+	sql := fmt.Sprintf(`SELECT data FROM %v%v`, ds.table, ds.whereVisible())
 	rows, err := conn.Query(ctx, sql)
 	if err != nil {
-		return nil, cloudy.Error(ctx, "Error querying database : %v", err)
+		return nil, ds.wrapErr("get all", "", err)
 	}
 	rtn, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*T, error) {
 		var jsonResult []byte
@@ -273,6 +512,9 @@ func (ds *JsonDataStore[T]) GetAll(ctx context.Context) ([]*T, error) {
 		}
 		return fromByte[T](jsonResult)
 	})
+	if err != nil {
+		return nil, ds.wrapErr("get all", "", err)
+	}
 	return rtn, nil
 }
 
@@ -285,30 +527,70 @@ func (ds *JsonDataStore[T]) Delete(ctx context.Context, key string) error {
 	defer ds.returnConnection(ctx, conn)
 
 	sqlDelete := fmt.Sprintf(`DELETE FROM %v where ID=$1`, ds.table)
+	if ds.opts.softDelete {
+		sqlDelete = fmt.Sprintf(`UPDATE %v SET deleted_at = CURRENT_TIMESTAMP where ID=$1 AND deleted_at IS NULL`, ds.table)
+	}
 	_, err = conn.Exec(ctx, sqlDelete, key)
 	if err != nil {
-		return fmt.Errorf("error deleteing %v from %v : %v", key, ds.table, err)
+		return ds.wrapErr("delete", key, err)
 	}
 	return nil
 }
 
-// Deletes an item
+// deleteChunkSize is the most keys DeleteKeys sends in a single statement
+const deleteChunkSize = 5000
+
+// DeleteAll deletes the items with the given keys. Use DeleteKeys to learn
+// which of them existed.
 func (ds *JsonDataStore[T]) DeleteAll(ctx context.Context, key []string) error {
+	_, err := ds.DeleteKeys(ctx, key)
+	return err
+}
+
+// DeleteKeys deletes the items with the given keys and returns the keys that
+// were actually deleted. Large key lists are sent in chunks within a single
+// transaction.
+func (ds *JsonDataStore[T]) DeleteKeys(ctx context.Context, keys []string) ([]string, error) {
 	conn, err := ds.checkConnection(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer ds.returnConnection(ctx, conn)
 
-	sqlDelete := fmt.Sprintf(`DELETE FROM %v WHERE ID IN ('%v')`, ds.table, strings.Join(key, "','"))
-	_, err = conn.Exec(ctx, sqlDelete)
+	sqlDelete := fmt.Sprintf(`DELETE FROM %v WHERE ID = ANY($1) RETURNING id`, ds.table)
+	if ds.opts.softDelete {
+		sqlDelete = fmt.Sprintf(`UPDATE %v SET deleted_at = CURRENT_TIMESTAMP WHERE ID = ANY($1) AND deleted_at IS NULL RETURNING id`, ds.table)
+	}
+
+	var deleted []string
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		for start := 0; start < len(keys); start += deleteChunkSize {
+			end := min(start+deleteChunkSize, len(keys))
+			rows, err := tx.Query(ctx, sqlDelete, keys[start:end])
+			if err != nil {
+				return err
+			}
+			ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+			if err != nil {
+				return err
+			}
+			deleted = append(deleted, ids...)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("error deleteing %v from  %v", ds.table, err)
+		return nil, ds.wrapErr("delete", "", err)
 	}
-	return nil
+	return deleted, nil
 }
 
+// SaveAll stores the items in a single transaction. From the bulk threshold
+// (see WithBulkThreshold) on the items are written with BulkSave.
 func (m *JsonDataStore[T]) SaveAll(ctx context.Context, items []*T, key []string) error {
+	if m.useBulk(len(items)) {
+		_, err := m.BulkSave(ctx, items, key)
+		return err
+	}
 
 	conn, err := m.checkConnection(ctx)
 	if err != nil {
@@ -323,19 +605,149 @@ func (m *JsonDataStore[T]) SaveAll(ctx context.Context, items []*T, key []string
 			if err != nil {
 				return fmt.Errorf("error converting to json, %v", err)
 			}
-			sqlUpsert := fmt.Sprintf(`INSERT INTO %v (id, data) VALUES ($1, $2) 
-				ON CONFLICT (id) DO UPDATE 
-				SET version =  %v.version + 1, last_updated = CURRENT_TIMESTAMP, data=$2;`, m.table, m.table)
-			// _, err = conn.Exec(ctx, sqlUpsert, key, data)
-			// sqlUpsert := fmt.Sprintf(`INSERT INTO %v (id, data) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET data=$2;`, m.table)
-			_, err = conn.Exec(ctx, sqlUpsert, key[i], data)
+			_, err = tx.Exec(ctx, m.upsertSql(), key[i], data)
 			if err != nil {
-				return fmt.Errorf("database error, %v", err)
+				return m.wrapErr("save", key[i], err)
 			}
 		}
 		return nil
 	})
-	return err
+	return m.wrapErr("save", "", err)
+}
+
+// createSql inserts a new document and returns the given column. No row is
+// returned when the key is in use, which does not depend on the language of
+// the server messages as a unique violation would. With soft delete or expiry
+// a deleted or expired document with the same key is replaced, as it would be
+// by Save.
+func (ds *JsonDataStore[T]) createSql(returning string) string {
+	if visible := ds.visibleCondition("t"); visible != "" {
+		return fmt.Sprintf(`INSERT INTO %v AS t (id, data) VALUES ($1, $2)
+			ON CONFLICT (id) DO UPDATE
+			SET version = t.version + 1, last_updated = CURRENT_TIMESTAMP, data = $2%v
+			WHERE NOT (%v)
+			RETURNING t.%v`, ds.table, ds.reviveSet(), visible, returning)
+	}
+	return fmt.Sprintf(`INSERT INTO %v (id, data) VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+		RETURNING %v`, ds.table, returning)
+}
+
+func (ds *JsonDataStore[T]) create(ctx context.Context, conn querier, item *T, key string) error {
+	data, err := toByte(item)
+	if err != nil {
+		return fmt.Errorf("error converting to json, %v", err)
+	}
+
+	var id string
+	err = conn.QueryRow(ctx, ds.createSql("id"), key, data).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &Error{Op: "create", Table: ds.table, Key: key, Kind: ErrAlreadyExists}
+	}
+	return ds.wrapErr("create", key, err)
+}
+
+func (ds *JsonDataStore[T]) update(ctx context.Context, conn querier, item *T, key string) (bool, error) {
+	data, err := toByte(item)
+	if err != nil {
+		return false, fmt.Errorf("error converting to json, %v", err)
+	}
+
+	sqlUpdate := fmt.Sprintf(`UPDATE %v SET version = version + 1, last_updated = CURRENT_TIMESTAMP, data = $2
+		WHERE id = $1%v`, ds.table, ds.andVisible())
+	tag, err := conn.Exec(ctx, sqlUpdate, key, data)
+	if err != nil {
+		return false, ds.wrapErr("update", key, err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Create stores a new item and returns ErrAlreadyExists when the key is
+// already in use
+func (ds *JsonDataStore[T]) Create(ctx context.Context, item *T, key string) error {
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	return ds.create(ctx, conn, item, key)
+}
+
+// Update replaces an existing item and returns ErrNotFound when the key does
+// not exist
+func (ds *JsonDataStore[T]) Update(ctx context.Context, item *T, key string) error {
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	found, err := ds.update(ctx, conn, item, key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return notFoundError("update", ds.table, key)
+	}
+	return nil
+}
+
+// CreateAll is the batch form of Create. The items are written in a single
+// transaction and nothing is written when any key is already in use.
+func (ds *JsonDataStore[T]) CreateAll(ctx context.Context, items []*T, keys []string) error {
+	if len(items) != len(keys) {
+		return errors.New("items and keys must be the same length")
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		for i, item := range items {
+			if err := ds.create(ctx, tx, item, keys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return ds.wrapErr("create", "", err)
+}
+
+// UpdateAll is the batch form of Update. The items are written in a single
+// transaction and nothing is written when any key does not exist, in which
+// case the error lists every missing key.
+func (ds *JsonDataStore[T]) UpdateAll(ctx context.Context, items []*T, keys []string) error {
+	if len(items) != len(keys) {
+		return errors.New("items and keys must be the same length")
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		var missing []string
+		for i, item := range items {
+			found, err := ds.update(ctx, tx, item, keys[i])
+			if err != nil {
+				return err
+			}
+			if !found {
+				missing = append(missing, keys[i])
+			}
+		}
+		if len(missing) > 0 {
+			return notFoundError("update", ds.table, strings.Join(missing, ", "))
+		}
+		return nil
+	})
+	return ds.wrapErr("update", "", err)
 }
 
 func (m *JsonDataStore[T]) DeleteQuery(ctx context.Context, query *datastore.SimpleQuery) ([]string, error) {
@@ -345,12 +757,19 @@ func (m *JsonDataStore[T]) DeleteQuery(ctx context.Context, query *datastore.Sim
 	}
 	defer m.returnConnection(ctx, conn)
 
-	sql := new(PgQueryConverter).ConvertDelete(query, m.table)
+	qc := m.converter()
+	sql, args := qc.ConvertDeleteWithArgs(query, m.table)
+	if m.opts.softDelete {
+		sql, args = qc.ConvertUpdateWithArgs(query, m.table, "deleted_at = CURRENT_TIMESTAMP")
+	}
+	if err := qc.Err(); err != nil {
+		return nil, err
+	}
 
 	// Execute the query
-	rows, err := conn.Query(ctx, sql)
+	rows, err := conn.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, fmt.Errorf("delete query failed: %w", err)
+		return nil, m.wrapErr("delete", "", err)
 	}
 	defer rows.Close()
 
@@ -359,14 +778,14 @@ func (m *JsonDataStore[T]) DeleteQuery(ctx context.Context, query *datastore.Sim
 	for rows.Next() {
 		var id string
 		if err := rows.Scan(&id); err != nil {
-			return deletedIDs, fmt.Errorf("error scanning row: %w", err)
+			return deletedIDs, m.wrapErr("delete", "", err)
 		}
 		deletedIDs = append(deletedIDs, id)
 	}
 
 	// Check for any errors encountered during iteration
 	if err := rows.Err(); err != nil {
-		return deletedIDs, fmt.Errorf("error iterating rows: %w", err)
+		return deletedIDs, m.wrapErr("delete", "", err)
 	}
 
 	return deletedIDs, nil
@@ -380,19 +799,21 @@ func (ds *JsonDataStore[T]) Exists(ctx context.Context, key string) (bool, error
 	}
 	defer ds.returnConnection(ctx, conn)
 
-	sqlExists := fmt.Sprintf(`SELECT ID FROM %v where ID=$1`, ds.table)
+	sqlExists := fmt.Sprintf(`SELECT ID FROM %v where ID=$1%v`, ds.table, ds.andVisible())
 	rows, err := conn.Query(ctx, sqlExists, key)
 	if err != nil {
-		return false, cloudy.Error(ctx, "Error querying database : %v", err)
+		return false, ds.wrapErr("exists", key, err)
 	}
 
 	defer rows.Close()
 	if rows.Next() {
 		return true, nil
 	}
-	return false, nil
+	return false, ds.wrapErr("exists", key, rows.Err())
 }
 
+// Count returns the number of documents matching the query. The sort and
+// paging of the query are ignored.
 func (ds *JsonDataStore[T]) Count(ctx context.Context, query *datastore.SimpleQuery) (int, error) {
 	conn, err := ds.checkConnection(ctx)
 	if err != nil {
@@ -400,14 +821,20 @@ func (ds *JsonDataStore[T]) Count(ctx context.Context, query *datastore.SimpleQu
 	}
 	defer ds.returnConnection(ctx, conn)
 
-	query.Colums = []string{}
-	sql := new(PgQueryConverter).Convert(query, ds.table)
-	sql = strings.Replace(sql, "SELECT data", "SELECT COUNT(*) as cnt", 1)
-	row := conn.QueryRow(ctx, sql)
+	countQuery := *query
+	countQuery.SortBy, countQuery.Size, countQuery.Offset = nil, 0, 0
+	qc := ds.converter()
+	sql, args := qc.ConvertAggregateWithArgs(&countQuery, ds.table, &Aggregation{
+		Aggregates: []Aggregate{{Name: "cnt", Func: AggregateCount}},
+	})
+	if err := qc.Err(); err != nil {
+		return -1, err
+	}
+	row := conn.QueryRow(ctx, sql, args...)
 	var cnt int
 	err = row.Scan(&cnt)
 	if err != nil {
-		return -1, fmt.Errorf("error querying database: %v", err)
+		return -1, ds.wrapErr("count", "", err)
 	}
 	return cnt, nil
 }
@@ -420,10 +847,14 @@ func (ds *JsonDataStore[T]) Query(ctx context.Context, query *datastore.SimpleQu
 	}
 	defer ds.returnConnection(ctx, conn)
 
-	sql := new(PgQueryConverter).Convert(query, ds.table)
-	rows, err := conn.Query(ctx, sql)
+	qc := ds.converter()
+	sql, args := qc.ConvertWithArgs(query, ds.table)
+	if err := qc.Err(); err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, fmt.Errorf("error querying database : %v", err)
+		return nil, ds.wrapErr("query", "", err)
 	}
 	rtn, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*T, error) {
 		var jsonResult []byte
@@ -433,7 +864,10 @@ func (ds *JsonDataStore[T]) Query(ctx context.Context, query *datastore.SimpleQu
 		}
 		return fromByte[T](jsonResult)
 	})
-	return rtn, err
+	if err != nil {
+		return nil, ds.wrapErr("query", "", err)
+	}
+	return rtn, nil
 }
 
 func (ds *JsonDataStore[T]) QueryAndUpdate(ctx context.Context, query *datastore.SimpleQuery, updater func(ctx context.Context, items []*T) ([]*T, error)) ([]*T, error) {
@@ -443,19 +877,25 @@ func (ds *JsonDataStore[T]) QueryAndUpdate(ctx context.Context, query *datastore
 	}
 	defer ds.returnConnection(ctx, conn)
 
-	sql := new(PgQueryConverter).Convert(query, ds.table)
+	qc := ds.converter()
+	sql, args := qc.ConvertWithArgs(query, ds.table)
+	if err := qc.Err(); err != nil {
+		return nil, err
+	}
 
 	var updated []*T
+	var updaterErr error
 
-	// All this runs in a single transaction
+	// All this runs in a single transaction, which the updater joins through
+	// the context
 	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
 		sql = sql + " FOR UPDATE"
-		rows, err := conn.Query(ctx, sql)
+		rows, err := tx.Query(ctx, sql, args...)
 		if err != nil {
-			return err
+			return ds.wrapErr("query and update", "", err)
 		}
 
-		ctx = ds.CtxSetConnection(ctx, conn)
+		txCtx := withTx(ctx, ds.provider, tx)
 		rtn, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*T, error) {
 			var jsonResult []byte
 			err = rows.Scan(&jsonResult)
@@ -465,10 +905,17 @@ func (ds *JsonDataStore[T]) QueryAndUpdate(ctx context.Context, query *datastore
 			return fromByte[T](jsonResult)
 		})
 
-		updated, err = updater(ctx, rtn)
+		if err != nil {
+			return ds.wrapErr("query and update", "", err)
+		}
 
-		return err
+		updated, updaterErr = updater(txCtx, rtn)
+
+		return updaterErr
 	})
+	if err != nil && err != updaterErr {
+		return nil, ds.wrapErr("query and update", "", err)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -482,16 +929,23 @@ func (ds *JsonDataStore[T]) QueryAsMap(ctx context.Context, query *datastore.Sim
 	}
 	defer ds.returnConnection(ctx, conn)
 
-	sql := new(PgQueryConverter).Convert(query, ds.table)
+	qc := ds.converter()
+	sql, args := qc.ConvertWithArgs(query, ds.table)
+	if err := qc.Err(); err != nil {
+		return nil, err
+	}
 
-	rows, err := conn.Query(ctx, sql)
+	rows, err := conn.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, cloudy.Error(ctx, "Error querying database : %v", err)
+		return nil, ds.wrapErr("query", "", err)
 	}
 	rtn, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (map[string]interface{}, error) {
 		return pgx.RowToMap(row)
 	})
-	return rtn, err
+	if err != nil {
+		return nil, ds.wrapErr("query", "", err)
+	}
+	return rtn, nil
 }
 
 func (ds *JsonDataStore[T]) QueryTable(ctx context.Context, query *datastore.SimpleQuery) ([][]interface{}, error) {
@@ -501,13 +955,17 @@ func (ds *JsonDataStore[T]) QueryTable(ctx context.Context, query *datastore.Sim
 	}
 	defer ds.returnConnection(ctx, conn)
 
-	sql := new(PgQueryConverter).Convert(query, ds.table)
+	qc := ds.converter()
+	sql, args := qc.ConvertWithArgs(query, ds.table)
+	if err := qc.Err(); err != nil {
+		return nil, err
+	}
 	// Fix the SQL
 	// sql = strings.Replace(sql, "SELECT data ,", "SELECT ", 1)
 
-	rows, err := conn.Query(ctx, sql)
+	rows, err := conn.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, cloudy.Error(ctx, "Error querying database : %v", err)
+		return nil, ds.wrapErr("query", "", err)
 	}
 
 	defer rows.Close()
@@ -515,11 +973,11 @@ func (ds *JsonDataStore[T]) QueryTable(ctx context.Context, query *datastore.Sim
 	for rows.Next() {
 		vals, err := rows.Values()
 		if err != nil {
-			return rtn, err
+			return rtn, ds.wrapErr("query", "", err)
 		}
 		rtn = append(rtn, vals)
 	}
-	return rtn, nil
+	return rtn, ds.wrapErr("query", "", rows.Err())
 }
 
 func (ds *JsonDataStore[T]) CtxSetConnection(ctx context.Context, conn *pgxpool.Conn) context.Context {
@@ -373,3 +373,183 @@ func TestJsonDatastoreQueryAndUpdate(t *testing.T) {
 	require.Equal(t, item2.Name, "Updated")
 
 }
+
+func TestJsonDatastoreQueryQuotedValue(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems")
+	err := ds.Open(ctx, nil)
+	require.NoError(t, err)
+
+	item := &TestItem{ID: "1", Name: "O'Brien"}
+	other := &TestItem{ID: "2", Name: "Smith"}
+	require.NoError(t, ds.Save(ctx, item, item.ID))
+	require.NoError(t, ds.Save(ctx, other, other.ID))
+
+	q := datastore.NewQuery()
+	q.Conditions.Equals("name", "O'Brien")
+	items, err := ds.Query(ctx, q)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, item.ID, items[0].ID)
+
+	cnt, err := ds.Count(ctx, q)
+	require.NoError(t, err)
+	require.Equal(t, 1, cnt)
+
+	q2 := datastore.NewQuery()
+	q2.Conditions.Equals("name", "x' OR '1'='1")
+	items2, err := ds.Query(ctx, q2)
+	require.NoError(t, err)
+	require.Empty(t, items2)
+
+	ids, err := ds.DeleteQuery(ctx, q)
+	require.NoError(t, err)
+	_ = ids
+
+	exists, err := ds.Exists(ctx, other.ID)
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+func TestJsonDatastoreTableNames(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+
+	conn, err := p.Acquire(ctx)
+	require.NoError(t, err)
+	_, err = conn.Exec(ctx, `CREATE SCHEMA "MyApp"`)
+	require.NoError(t, err)
+	p.Return(ctx, conn)
+
+	ds := NewJsonDatastore[TestItem](ctx, p, `"MyApp"."TestItems"`)
+	require.NoError(t, ds.Open(ctx, nil))
+	// Opening twice should not try to add the columns again
+	require.NoError(t, ds.Open(ctx, nil))
+
+	item := &TestItem{ID: "1", Name: "Mixed"}
+	require.NoError(t, ds.Save(ctx, item, item.ID))
+	require.NoError(t, ds.Save(ctx, item, item.ID))
+
+	meta, err := ds.GetMetadata(ctx, item.ID)
+	require.NoError(t, err)
+	require.Len(t, meta, 1)
+	require.Equal(t, int64(2), meta[0].Version)
+
+	bad := NewJsonDatastore[TestItem](ctx, p, "items; DROP TABLE testitems")
+	err = bad.Open(ctx, nil)
+	require.ErrorIs(t, err, ErrInvalidIdentifier)
+}
+
+func TestJsonDatastoreCreateUpdate(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems", WithSoftDelete())
+	require.NoError(t, ds.Open(ctx, nil))
+
+	item := &TestItem{ID: "1", Name: "first"}
+	require.NoError(t, ds.Create(ctx, item, item.ID))
+	require.ErrorIs(t, ds.Create(ctx, item, item.ID), ErrAlreadyExists)
+
+	item.Name = "updated"
+	require.NoError(t, ds.Update(ctx, item, item.ID))
+	require.ErrorIs(t, ds.Update(ctx, &TestItem{ID: "2"}, "2"), ErrNotFound)
+
+	stored, err := ds.Get(ctx, item.ID)
+	require.NoError(t, err)
+	require.Equal(t, "updated", stored.Name)
+
+	// A soft deleted key can be created again but not updated
+	require.NoError(t, ds.Delete(ctx, item.ID))
+	require.ErrorIs(t, ds.Update(ctx, item, item.ID), ErrNotFound)
+	require.NoError(t, ds.Create(ctx, item, item.ID))
+
+	err = ds.CreateAll(ctx, []*TestItem{{ID: "3"}, {ID: "1"}}, []string{"3", "1"})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+	exists, err := ds.Exists(ctx, "3")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	require.NoError(t, ds.CreateAll(ctx, []*TestItem{{ID: "3"}, {ID: "4"}}, []string{"3", "4"}))
+
+	err = ds.UpdateAll(ctx, []*TestItem{{ID: "3", Name: "x"}, {ID: "5"}, {ID: "6"}}, []string{"3", "5", "6"})
+	require.ErrorIs(t, err, ErrNotFound)
+	require.ErrorContains(t, err, "5, 6")
+	stored, err = ds.Get(ctx, "3")
+	require.NoError(t, err)
+	require.Equal(t, "", stored.Name)
+
+	require.NoError(t, ds.UpdateAll(ctx, []*TestItem{{ID: "3", Name: "x"}, {ID: "4", Name: "y"}}, []string{"3", "4"}))
+}
+
+func TestJsonDatastoreGetMany(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems")
+	require.NoError(t, ds.Open(ctx, nil))
+
+	require.NoError(t, ds.Save(ctx, &TestItem{ID: "1", Name: "One"}, "1"))
+	require.NoError(t, ds.Save(ctx, &TestItem{ID: "2", Name: "Two"}, "2"))
+
+	found, err := ds.GetMany(ctx, []string{"1", "2", "missing"})
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+	require.Equal(t, "Two", found["2"].Name)
+
+	ordered, err := ds.GetManyOrdered(ctx, []string{"2", "missing", "1"})
+	require.NoError(t, err)
+	require.Len(t, ordered, 3)
+	require.Equal(t, "Two", ordered[0].Name)
+	require.Nil(t, ordered[1])
+	require.Equal(t, "One", ordered[2].Name)
+}
+
+func TestJsonDatastoreDeleteKeys(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems")
+	require.NoError(t, ds.Open(ctx, nil))
+
+	keys := []string{"1", "O'Brien", "3"}
+	for _, key := range keys {
+		require.NoError(t, ds.Save(ctx, &TestItem{ID: key}, key))
+	}
+
+	deleted, err := ds.DeleteKeys(ctx, []string{"O'Brien", "3", "missing"})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"O'Brien", "3"}, deleted)
+
+	require.NoError(t, ds.DeleteAll(ctx, []string{"1"}))
+	all, err := ds.GetAll(ctx)
+	require.NoError(t, err)
+	require.Empty(t, all)
+
+	t.Run("Query", func(t *testing.T) {
+		require.NoError(t, ds.Save(ctx, &TestItem{ID: "4", Name: "gone"}, "4"))
+		q := datastore.NewQuery()
+		q.Conditions.Equals("name", "gone")
+		ids, err := ds.DeleteQuery(ctx, q)
+		require.NoError(t, err)
+		require.Equal(t, []string{"4"}, ids)
+	})
+}
@@ -0,0 +1,177 @@
+package cloudypg
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	jsonbSyncSuffix   = "_jsonb_sync"
+	jsonbSyncFnSuffix = "_jsonb_sync_fn"
+
+	// DefaultMigrationBatchSize is the number of rows converted per statement
+	// by MigrateToJsonb when no batch size is given
+	DefaultMigrationBatchSize = 1000
+)
+
+// IsJsonb reports if the data column is JSONB. This is known once the
+// datastore has been opened.
+func (ds *JsonDataStore[T]) IsJsonb() bool {
+	return ds.jsonb.Load()
+}
+
+// dataCast returns the cast from JSONB to the type of the data column
+func (ds *JsonDataStore[T]) dataCast() string {
+	if ds.jsonb.Load() {
+		return ""
+	}
+	return "::json"
+}
+
+// detectJsonb looks up the type of the data column so the queries can be
+// generated for it
+func (ds *JsonDataStore[T]) detectJsonb(ctx context.Context, conn querier) (bool, error) {
+	var schema *string
+	if ds.tableName.Schema != "" {
+		schema = &ds.tableName.Schema
+	}
+
+	var dataType string
+	err := conn.QueryRow(ctx, `SELECT data_type FROM information_schema.columns
+		WHERE table_schema = COALESCE($1, current_schema()) AND table_name = $2 AND column_name = 'data'`,
+		schema, ds.tableName.Name).Scan(&dataType)
+	if err != nil {
+		return false, ds.wrapErr("detect data type", "", err)
+	}
+	return dataType == "jsonb", nil
+}
+
+var jsonbPrepareSql = `
+ALTER TABLE $TABLE$ ADD COLUMN IF NOT EXISTS data_jsonb JSONB;
+
+CREATE OR REPLACE FUNCTION $SYNCFN$() RETURNS trigger AS $cloudypg$
+BEGIN
+    NEW.data_jsonb := NEW.data::jsonb;
+    RETURN NEW;
+END;
+$cloudypg$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS $SYNCTRIGGER$ ON $TABLE$;
+CREATE TRIGGER $SYNCTRIGGER$ BEFORE INSERT OR UPDATE ON $TABLE$
+    FOR EACH ROW EXECUTE FUNCTION $SYNCFN$();
+`
+
+var jsonbBackfillSql = `
+UPDATE $TABLE$ SET data_jsonb = data::jsonb
+WHERE id IN (
+    SELECT id FROM $TABLE$
+    WHERE data_jsonb IS NULL AND data IS NOT NULL
+    LIMIT $1
+    FOR UPDATE SKIP LOCKED
+)`
+
+var jsonbSwapSql = `
+SET LOCAL lock_timeout = '5s';
+LOCK TABLE $TABLE$ IN ACCESS EXCLUSIVE MODE;
+UPDATE $TABLE$ SET data_jsonb = data::jsonb WHERE data_jsonb IS NULL AND data IS NOT NULL;
+DROP TRIGGER IF EXISTS $SYNCTRIGGER$ ON $TABLE$;
+DROP TRIGGER IF EXISTS $HISTORYTRIGGER$ ON $TABLE$;
+DROP TRIGGER IF EXISTS $CHANGESTRIGGER$ ON $TABLE$;
+ALTER TABLE $TABLE$ DROP COLUMN data;
+ALTER TABLE $TABLE$ RENAME COLUMN data_jsonb TO data;
+DROP FUNCTION IF EXISTS $SYNCFN$();
+`
+
+// MigrateToJsonb converts the data column of an existing JSON table to JSONB
+// without holding a long exclusive lock. A data_jsonb column is added and kept
+// in sync by a trigger, the existing rows are converted in batches of
+// batchSize rows (each its own short transaction), and finally the columns are
+// swapped in one brief transaction that waits at most 5 seconds for its lock.
+// The migration can be run again if it fails part way. Expression indexes on
+// the old data column are dropped with it. Declared indexes are created again
+// for the new column but any others need to be recreated by hand. Other
+// instances holding prepared statements for the table may see one error after
+// the swap. The number of converted rows is returned.
+func (ds *JsonDataStore[T]) MigrateToJsonb(ctx context.Context, batchSize int) (int64, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultMigrationBatchSize
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	isJsonb, err := ds.detectJsonb(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	if isJsonb {
+		ds.jsonb.Store(true)
+		return 0, nil
+	}
+
+	fn, err := ds.tableName.WithSuffix(jsonbSyncFnSuffix)
+	if err != nil {
+		return 0, err
+	}
+	replacer := strings.NewReplacer(
+		"$SYNCFN$", fn.Sanitize(),
+		"$SYNCTRIGGER$", QuoteIdentifier(ds.tableName.Name+jsonbSyncSuffix),
+		"$HISTORYTRIGGER$", QuoteIdentifier(ds.tableName.Name+historySuffix),
+		"$CHANGESTRIGGER$", QuoteIdentifier(ds.tableName.Name+changesSuffix),
+		"$TABLE$", ds.table,
+	)
+
+	// 1. Add the new column and keep it in sync with writes from now on
+	if _, err = conn.Exec(ctx, replacer.Replace(jsonbPrepareSql)); err != nil {
+		return 0, ds.wrapErr("migrate to jsonb", "", err)
+	}
+
+	// 2. Convert the existing rows a batch at a time
+	var converted int64
+	backfill := replacer.Replace(jsonbBackfillSql)
+	for {
+		tag, err := conn.Exec(ctx, backfill, batchSize)
+		if err != nil {
+			return converted, ds.wrapErr("migrate to jsonb", "", err)
+		}
+		converted += tag.RowsAffected()
+		if tag.RowsAffected() == 0 {
+			break
+		}
+	}
+
+	// 3. Swap the columns
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, replacer.Replace(jsonbSwapSql))
+		return err
+	})
+	if err != nil {
+		return converted, ds.wrapErr("migrate to jsonb", "", err)
+	}
+	ds.jsonb.Store(true)
+
+	// The history and change triggers depend on the data column so they are
+	// created again
+	if ds.opts.history {
+		if err = ds.createHistory(ctx, conn); err != nil {
+			return converted, err
+		}
+	}
+	if ds.opts.changeFeed {
+		if err = ds.createChangeFeed(ctx, conn); err != nil {
+			return converted, err
+		}
+	}
+	if len(ds.opts.indexes) > 0 {
+		if _, err = ds.ensureIndexes(ctx, conn); err != nil {
+			return converted, err
+		}
+	}
+
+	return converted, nil
+}
@@ -0,0 +1,76 @@
+package cloudypg
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJsonDatastoreMigrateToJsonb(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[datastore.TestItem](ctx, p, "jsonitems")
+
+	// Create a table with a JSON data column
+	conn, err := p.Acquire(ctx)
+	require.NoError(t, err)
+	_, err = conn.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %v (
+			id varchar(200) NOT NULL PRIMARY KEY,
+			version integer DEFAULT 1,
+			last_updated timestamp DEFAULT CURRENT_TIMESTAMP,
+			date_created timestamp DEFAULT CURRENT_TIMESTAMP,
+			data json
+		);`, ds.table))
+	require.NoError(t, err)
+	p.Return(ctx, conn)
+
+	err = ds.Open(ctx, nil)
+	require.NoError(t, err)
+	require.False(t, ds.IsJsonb())
+
+	for i := 0; i < 25; i++ {
+		item := &datastore.TestItem{ID: fmt.Sprintf("%02d", i), Name: fmt.Sprintf("item%v", i%5)}
+		require.NoError(t, ds.Save(ctx, item, item.ID))
+	}
+
+	converted, err := ds.MigrateToJsonb(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(25), converted)
+	require.True(t, ds.IsJsonb())
+
+	conn, err = p.Acquire(ctx)
+	require.NoError(t, err)
+	isJsonb, err := ds.detectJsonb(ctx, conn)
+	p.Return(ctx, conn)
+	require.NoError(t, err)
+	require.True(t, isJsonb)
+
+	item, err := ds.Get(ctx, "07")
+	require.NoError(t, err)
+	require.NotNil(t, item)
+	require.Equal(t, "item2", item.Name)
+
+	q := datastore.NewQuery()
+	q.Conditions.Equals("name", "item3")
+	items, err := ds.Query(ctx, q)
+	require.NoError(t, err)
+	require.Len(t, items, 5)
+
+	// Running again is a no-op
+	converted, err = ds.MigrateToJsonb(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), converted)
+
+	require.NoError(t, ds.Save(ctx, &datastore.TestItem{ID: "99", Name: "new"}, "99"))
+	item, err = ds.Get(ctx, "99")
+	require.NoError(t, err)
+	require.Equal(t, "new", item.Name)
+}
@@ -13,45 +13,116 @@ import (
 
 var _ keyvalue.WritableKeyValueStore = (*KeyValueStore)(nil)
 
+// kvConn is the part of pgx.Conn and pgx.Tx used by the KeyValueStore
+type kvConn interface {
+	querier
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
 type KeyValueStore struct {
-	conn          *pgx.Conn
+	conn          kvConn
+	ctx           context.Context
+	provider      PostgresqlConnectionProvider
 	table         string
 	encryptionKey string
 }
 
+// KeyValueStoreOption configures a KeyValueStore
+type KeyValueStoreOption func(kv *KeyValueStore)
+
+// WithTxProvider names the provider whose RunInTx transactions the store joins
+// through WithContext. It must connect to the same database as the connection
+// the store was created with.
+func WithTxProvider(provider PostgresqlConnectionProvider) KeyValueStoreOption {
+	return func(kv *KeyValueStore) {
+		kv.provider = provider
+	}
+}
+
 type SecureKeyValueStore struct {
 	KeyValueStore
 }
 
-func NewKeyValueStore(ctx context.Context, tablename string, conn *pgx.Conn) (*KeyValueStore, error) {
+func NewKeyValueStore(ctx context.Context, tablename string, conn *pgx.Conn, opts ...KeyValueStoreOption) (*KeyValueStore, error) {
+	name, err := ParseTableName(tablename)
+	if err != nil {
+		return nil, err
+	}
+
 	kv := &KeyValueStore{
 		conn:  conn,
-		table: tablename,
+		table: name.Sanitize(),
 	}
-	err := kv.Init(ctx)
+	for _, opt := range opts {
+		opt(kv)
+	}
+	err = kv.Init(ctx)
 	return kv, err
 }
 
-func NewSecretKeyValueStore(ctx context.Context, tablename string, conn *pgx.Conn, encryptionKey string) (*KeyValueStore, error) {
+func NewSecretKeyValueStore(ctx context.Context, tablename string, conn *pgx.Conn, encryptionKey string, opts ...KeyValueStoreOption) (*KeyValueStore, error) {
+	name, err := ParseTableName(tablename)
+	if err != nil {
+		return nil, err
+	}
+
 	kv := &KeyValueStore{
 		conn:          conn,
-		table:         tablename,
+		table:         name.Sanitize(),
 		encryptionKey: encryptionKey,
 	}
-	err := kv.Init(ctx)
+	for _, opt := range opts {
+		opt(kv)
+	}
+	err = kv.Init(ctx)
 	return kv, err
 }
 
+// WithContext returns a copy of the store that runs its statements with the
+// context, and in the transaction RunInTx started on the WithTxProvider
+// provider when there is one. Transactions on other providers are never
+// joined. keyvalue.KeyValueStore has no context in its methods so this is how
+// the store joins a transaction shared with the JsonDataStores.
+func (kv *KeyValueStore) WithContext(ctx context.Context) *KeyValueStore {
+	rtn := *kv
+	rtn.ctx = ctx
+	if kv.provider != nil {
+		if tx := txFromContext(ctx, kv.provider); tx != nil {
+			rtn.conn = tx
+		}
+	}
+	return &rtn
+}
+
+// WithTx returns a copy of the store that runs its statements with the context
+// in the given transaction
+func (kv *KeyValueStore) WithTx(ctx context.Context, tx pgx.Tx) *KeyValueStore {
+	rtn := *kv
+	rtn.ctx = ctx
+	rtn.conn = tx
+	return &rtn
+}
+
+func (kv *KeyValueStore) context() context.Context {
+	if kv.ctx != nil {
+		return kv.ctx
+	}
+	return context.Background()
+}
+
 func (kv *KeyValueStore) Init(ctx context.Context) error {
 	sql := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %v ( key varchar(1000) primary key, value varchar(4000));`, kv.table)
 
 	_, err := kv.conn.Exec(ctx, sql)
-	return err
+	return newError("create table", kv.table, "", err)
 }
 
 // --- KeyValueStore
+
+// Get returns the value of the key, or an empty string when the key does not
+// exist as the keyvalue.KeyValueStore contract expects
 func (kv *KeyValueStore) Get(key string) (string, error) {
-	ctx := context.Background()
+	ctx := kv.context()
 	nkey := keyvalue.NormalizeKey(key)
 
 	sql := fmt.Sprintf("SELECT value from %v WHERE key = $1", kv.table)
@@ -65,17 +136,16 @@ func (kv *KeyValueStore) Get(key string) (string, error) {
 		return "", nil
 	}
 
-	return "", err
+	return "", newError("get", kv.table, nkey, err)
 }
 
 func (kv *KeyValueStore) GetAll() (map[string]string, error) {
-	ctx := context.Background()
+	ctx := kv.context()
 	sql := fmt.Sprintf("SELECT key, value from %v", kv.table)
 
 	rows, err := kv.conn.Query(ctx, sql)
 	if err != nil {
-		fmt.Println(err)
-		return nil, cloudy.Error(ctx, "Error querying database : %v", err)
+		return nil, newError("get all", kv.table, "", err)
 	}
 
 	rowData, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) ([]string, error) {
@@ -88,7 +158,7 @@ func (kv *KeyValueStore) GetAll() (map[string]string, error) {
 		return []string{key, value}, nil
 	})
 	if err != nil {
-		return nil, cloudy.Error(ctx, "Error querying database : %v", err)
+		return nil, newError("get all", kv.table, "", err)
 	}
 
 	m := make(map[string]string)
@@ -99,6 +169,45 @@ func (kv *KeyValueStore) GetAll() (map[string]string, error) {
 	return m, nil
 }
 
+// GetMany returns the values of the keys in a single query. The map is keyed
+// by the keys as given and keys that do not exist are left out.
+func (kv *KeyValueStore) GetMany(keys []string) (map[string]string, error) {
+	ctx := kv.context()
+
+	byNormal := make(map[string][]string, len(keys))
+	nkeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		nkey := keyvalue.NormalizeKey(key)
+		if _, ok := byNormal[nkey]; !ok {
+			nkeys = append(nkeys, nkey)
+		}
+		byNormal[nkey] = append(byNormal[nkey], key)
+	}
+
+	sql := fmt.Sprintf("SELECT key, value from %v WHERE key = ANY($1)", kv.table)
+	rows, err := kv.conn.Query(ctx, sql, nkeys)
+	if err != nil {
+		return nil, newError("get many", kv.table, "", err)
+	}
+	defer rows.Close()
+
+	m := make(map[string]string, len(keys))
+	for rows.Next() {
+		var key string
+		var value string
+		if err = rows.Scan(&key, &value); err != nil {
+			return nil, newError("get many", kv.table, "", err)
+		}
+		for _, k := range byNormal[key] {
+			m[k] = value
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, newError("get many", kv.table, "", err)
+	}
+	return m, nil
+}
+
 // --- FilteredKeyValueStore
 func (kv *KeyValueStore) GetWithPrefix(prefix string) (map[string]string, error) {
 	return nil, nil
@@ -106,16 +215,16 @@ func (kv *KeyValueStore) GetWithPrefix(prefix string) (map[string]string, error)
 
 // --- WritableKeyValueStore
 func (kv *KeyValueStore) Set(key string, value string) error {
-	ctx := context.Background()
+	ctx := kv.context()
 	nkey := keyvalue.NormalizeKey(key)
 	sql := fmt.Sprintf(`INSERT INTO %v (key, value) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET value=$2;`, kv.table)
 
 	_, err := kv.conn.Exec(ctx, sql, nkey, value)
 
-	return err
+	return newError("set", kv.table, nkey, err)
 }
 func (kv *KeyValueStore) SetMany(items map[string]string) error {
-	ctx := context.Background()
+	ctx := kv.context()
 
 	batch := &pgx.Batch{}
 	for key, value := range items {
@@ -127,23 +236,20 @@ func (kv *KeyValueStore) SetMany(items map[string]string) error {
 	br := kv.conn.SendBatch(ctx, batch)
 	_, err := br.Exec()
 	if err != nil {
-		return err
+		br.Close()
+		return newError("set", kv.table, "", err)
 	}
 
 	err = br.Close()
-	if err != nil {
-		return err
-	}
-
-	return err
+	return newError("set", kv.table, "", err)
 }
 func (kv *KeyValueStore) Delete(key string) error {
-	ctx := context.Background()
+	ctx := kv.context()
 	nkey := keyvalue.NormalizeKey(key)
 	sql := fmt.Sprintf("DELETE FROM %v WHERE key = $1", kv.table)
 	_, err := kv.conn.Exec(ctx, sql, nkey)
 
-	return err
+	return newError("delete", kv.table, nkey, err)
 }
 
 func (kv *KeyValueStore) GetSecure(key string) (strfmt.Password, error) {
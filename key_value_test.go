@@ -5,6 +5,7 @@ import (
 
 	"github.com/appliedres/cloudy"
 	"github.com/appliedres/cloudy/keyvalue"
+	"github.com/stretchr/testify/require"
 )
 
 func TestKeyValue(t *testing.T) {
@@ -22,3 +23,19 @@ func TestKeyValue(t *testing.T) {
 	}
 	keyvalue.TestWritableKVStore(t, kv, keyvalue.TestStoreNormalForms)
 }
+
+func TestKeyValueGetMany(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	conn, err := Connect(ctx, cfg)
+	require.NoError(t, err)
+
+	kv, err := NewKeyValueStore(ctx, "keyvaluetest", conn)
+	require.NoError(t, err)
+	require.NoError(t, kv.SetMany(map[string]string{"one": "1", "two": "2"}))
+
+	values, err := kv.GetMany([]string{"one", "two", "missing"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"one": "1", "two": "2"}, values)
+}
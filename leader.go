@@ -27,9 +27,9 @@ func NewPgLeader() *PgLeader {
 }
 
 func (pgl *PgLeader) Connect(cfg interface{}) error {
-	pgc := cfg.(*PostgreSqlConfig)
-	if pgc == nil {
-		return errors.New("No Connection")
+	pgc, ok := cfg.(*PostgreSqlConfig)
+	if !ok || pgc == nil {
+		return &Error{Op: "connect", Kind: ErrConnection, Err: errors.New("no connection configuration")}
 	}
 	return pgl.ConnectPg(pgc)
 }
@@ -38,13 +38,19 @@ func (pgl *PgLeader) ConnectPg(cfg *PostgreSqlConfig) error {
 	pgl.cfg = cfg
 	conn, err := pgx.Connect(context.Background(), cfg.GetConnectionString())
 	pgl.conn = conn
-	return err
+	if err != nil {
+		return connectionError("", err)
+	}
+	return nil
 }
 
 func (pgl *PgLeader) ConnectStr(connStr string) error {
 	conn, err := pgx.Connect(context.Background(), connStr)
 	pgl.conn = conn
-	return err
+	if err != nil {
+		return connectionError("", err)
+	}
+	return nil
 }
 
 func (pgl *PgLeader) Elect(onElection func(isLeader bool)) {
@@ -86,7 +92,7 @@ func (pgl *PgLeader) runElection(leaderStatusC chan<- bool) {
 
 	var becameLeader bool
 	if err := conn.QueryRow(ctx, acquireLockQ).Scan(&becameLeader); err != nil {
-		log.Default().Printf("leader election failed with error: %s", err.Error())
+		log.Default().Printf("leader election failed with error: %s", newError("elect", "", "", err))
 		return
 	}
 	if !becameLeader {
@@ -100,15 +106,16 @@ func (pgl *PgLeader) runElection(leaderStatusC chan<- bool) {
 	for {
 		<-time.After(1 * time.Minute)
 
-		ctx2, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx2, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 
 		// ensure that an advisory lock is held on the ID 10 by the same connection as the one running this query
 		checkLockQ := "SELECT count(*) FROM pg_locks WHERE pid = pg_backend_pid() AND locktype = 'advisory' AND objid = 10"
 
 		var lockCount int
 		lockCountErr := conn.QueryRow(ctx2, checkLockQ).Scan(&lockCount)
+		cancel()
 		if lockCount == 0 {
-			log.Default().Printf("no longer leader: %s", lockCountErr.Error())
+			log.Default().Printf("no longer leader: %v", newError("elect", "", "", lockCountErr))
 			break
 		}
 	}
@@ -0,0 +1,225 @@
+package cloudypg
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/appliedres/cloudy/datastore"
+)
+
+// DefaultPageSize is used by QueryPage when the query does not set a Size
+const DefaultPageSize = 100
+
+// ErrInvalidPageToken is returned when a continuation token can not be decoded
+// or was created for a query with a different sort
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// Page is a single page of results from QueryPage. Next is the continuation
+// token for the following page and is empty on the last page.
+type Page[T any] struct {
+	Items []*T
+	Next  string
+}
+
+// pageCursor is the position of the last row of a page. Values holds the sort
+// keys in the same order as the query sort and Sort is used to make sure the
+// token is only used with the query that created it.
+type pageCursor struct {
+	Sort   string    `json:"s"`
+	Values []*string `json:"v"`
+	ID     string    `json:"id"`
+}
+
+func encodePageToken(c *pageCursor) (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodePageToken(token string, sortBy []*datastore.SortBy) (*pageCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPageToken, err)
+	}
+	c := &pageCursor{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPageToken, err)
+	}
+	if c.Sort != sortFingerprint(sortBy) || len(c.Values) != len(sortBy) {
+		return nil, fmt.Errorf("%w: token does not match the query sort", ErrInvalidPageToken)
+	}
+	return c, nil
+}
+
+// sortFingerprint describes the sort so that a token is rejected when the sort changes
+func sortFingerprint(sortBy []*datastore.SortBy) string {
+	parts := make([]string, len(sortBy))
+	for i, s := range sortBy {
+		dir := "asc"
+		if s.Descending {
+			dir = "desc"
+		}
+		parts[i] = s.Field + " " + dir
+	}
+	return strings.Join(parts, ",")
+}
+
+// ConvertPage converts the query into a keyset paginated SELECT. The sort keys
+// are selected after the data and id columns so the cursor for the next page
+// can be built from the last row. The id column breaks ties so the order is
+// stable. One extra row is requested to tell if there is a following page.
+func (qc *PgQueryConverter) ConvertPage(q *datastore.SimpleQuery, table string, cursor *pageCursor, limit int) (string, []any) {
+	qc.reset()
+
+	columns := []string{"data", "id"}
+	for _, s := range q.SortBy {
+		columns = append(columns, qc.toField(s.Field))
+	}
+	sql := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), table)
+
+	var where []string
+	if cond := qc.convertWhere(q.Conditions); cond != "" {
+		where = append(where, "( "+cond+" )")
+	}
+	if cursor != nil {
+		where = append(where, "( "+qc.convertKeyset(q.SortBy, cursor)+" )")
+	}
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	sort := qc.ConvertSort(q.SortBy)
+	if sort != "" {
+		sql += fmt.Sprintf(" ORDER BY %s, id ASC", sort)
+	} else {
+		sql += " ORDER BY id ASC"
+	}
+	sql += fmt.Sprintf(" LIMIT %v", limit+1)
+
+	return sql, qc.args
+}
+
+// convertKeyset builds the condition for rows that sort after the cursor. Each
+// sort key contributes "all previous keys equal and this key after", with NULLs
+// sorting last when ascending and first when descending as PostgreSQL does.
+func (qc *PgQueryConverter) convertKeyset(sortBy []*datastore.SortBy, cursor *pageCursor) string {
+	var ors []string
+	var equal []string
+	for i, s := range sortBy {
+		f := qc.toField(s.Field)
+		v := cursor.Values[i]
+
+		var after string
+		switch {
+		case !s.Descending && v == nil:
+			after = ""
+		case !s.Descending:
+			after = fmt.Sprintf("(%v > %v OR %v IS NULL)", f, qc.arg(*v), f)
+		case v == nil:
+			after = fmt.Sprintf("%v IS NOT NULL", f)
+		default:
+			after = fmt.Sprintf("%v < %v", f, qc.arg(*v))
+		}
+		if after != "" {
+			ors = append(ors, strings.Join(append(append([]string{}, equal...), after), " AND "))
+		}
+
+		if v == nil {
+			equal = append(equal, fmt.Sprintf("%v IS NULL", f))
+		} else {
+			equal = append(equal, fmt.Sprintf("%v = %v", f, qc.arg(*v)))
+		}
+	}
+	last := fmt.Sprintf("id > %v", qc.arg(cursor.ID))
+	ors = append(ors, strings.Join(append(equal, last), " AND "))
+
+	return "(" + strings.Join(ors, ") OR (") + ")"
+}
+
+// QueryPage runs the query one page at a time using keyset pagination. The
+// query Size is the page size (DefaultPageSize when not set) and the query sort
+// is used for ordering with the id as a tie breaker. Pass an empty token for the
+// first page and the returned Page.Next for the following ones. Offset and
+// recursive queries are not supported.
+func (ds *JsonDataStore[T]) QueryPage(ctx context.Context, query *datastore.SimpleQuery, token string) (*Page[T], error) {
+	if query.Offset > 0 {
+		return nil, errors.New("offset can not be used with keyset pagination")
+	}
+	if query.RecurseConfig != nil {
+		return nil, errors.New("recursive queries can not be paginated")
+	}
+
+	cursor, err := decodePageToken(token, query.SortBy)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := query.Size
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	qc := ds.converter()
+	sql, args := qc.ConvertPage(query, ds.table, cursor, limit)
+	if err := qc.Err(); err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, ds.wrapErr("query page", "", err)
+	}
+	defer rows.Close()
+
+	page := &Page[T]{}
+	var last *pageCursor
+	for rows.Next() {
+		if len(page.Items) == limit {
+			// There is at least one more row
+			page.Next, err = encodePageToken(last)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		var jsonResult []byte
+		c := &pageCursor{
+			Sort:   sortFingerprint(query.SortBy),
+			Values: make([]*string, len(query.SortBy)),
+		}
+		dest := []any{&jsonResult, &c.ID}
+		for i := range c.Values {
+			dest = append(dest, &c.Values[i])
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, ds.wrapErr("query page", "", err)
+		}
+
+		item, err := fromByte[T](jsonResult)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, item)
+		last = c
+	}
+	if err = rows.Err(); err != nil {
+		return nil, ds.wrapErr("query page", "", err)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,89 @@
+package cloudypg
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertPage(t *testing.T) {
+	q := datastore.NewQuery()
+	q.Conditions.Equals("parent", "1")
+	q.SortBy = []*datastore.SortBy{{Field: "name"}, {Field: "count", Descending: true}}
+
+	sql, args := new(PgQueryConverter).ConvertPage(q, "testitems", nil, 10)
+	require.Equal(t, "SELECT data, id, data->>'name', data->>'count' FROM testitems WHERE ( (data->>'parent') = $1 ) ORDER BY data->>'name' ASC, data->>'count' DESC, id ASC LIMIT 11", sql)
+	require.Equal(t, []any{"1"}, args)
+
+	name := "b"
+	cursor := &pageCursor{Values: []*string{&name, nil}, ID: "5"}
+	sql, args = new(PgQueryConverter).ConvertPage(q, "testitems", cursor, 10)
+	require.Contains(t, sql, "( ((data->>'name' > $2 OR data->>'name' IS NULL)) OR (data->>'name' = $3 AND data->>'count' IS NOT NULL) OR (data->>'name' = $3 AND data->>'count' IS NULL AND id > $4) )")
+	require.Equal(t, []any{"1", "b", "b", "5"}, args)
+}
+
+func TestPageToken(t *testing.T) {
+	sortBy := []*datastore.SortBy{{Field: "name"}}
+	name := "x"
+	token, err := encodePageToken(&pageCursor{Sort: sortFingerprint(sortBy), Values: []*string{&name}, ID: "1"})
+	require.NoError(t, err)
+
+	c, err := decodePageToken(token, sortBy)
+	require.NoError(t, err)
+	require.Equal(t, "1", c.ID)
+	require.Equal(t, "x", *c.Values[0])
+
+	_, err = decodePageToken(token, []*datastore.SortBy{{Field: "name", Descending: true}})
+	require.ErrorIs(t, err, ErrInvalidPageToken)
+
+	_, err = decodePageToken("not a token", sortBy)
+	require.ErrorIs(t, err, ErrInvalidPageToken)
+}
+
+func TestJsonDatastoreQueryPage(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems")
+	require.NoError(t, ds.Open(ctx, nil))
+
+	// Duplicate names make sure the id breaks ties
+	for i := 0; i < 25; i++ {
+		item := &TestItem{ID: fmt.Sprintf("item-%02d", i), Name: fmt.Sprintf("name-%v", i%4)}
+		require.NoError(t, ds.Save(ctx, item, item.ID))
+	}
+
+	q := datastore.NewQuery()
+	q.Size = 7
+	q.SortBy = []*datastore.SortBy{{Field: "name", Descending: true}}
+
+	seen := map[string]bool{}
+	var all []*TestItem
+	token := ""
+	pages := 0
+	for {
+		page, err := ds.QueryPage(ctx, q, token)
+		require.NoError(t, err)
+		pages++
+		for _, item := range page.Items {
+			require.False(t, seen[item.ID], "duplicate %v", item.ID)
+			seen[item.ID] = true
+		}
+		all = append(all, page.Items...)
+		if page.Next == "" {
+			break
+		}
+		token = page.Next
+	}
+	require.Equal(t, 4, pages)
+	require.Len(t, all, 25)
+	for i := 1; i < len(all); i++ {
+		require.True(t, all[i-1].Name > all[i].Name || (all[i-1].Name == all[i].Name && all[i-1].ID < all[i].ID))
+	}
+}
@@ -0,0 +1,295 @@
+package cloudypg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrPatchFailed is returned when a patch can not be applied to a document
+var ErrPatchFailed = errors.New("patch failed")
+
+// PatchError describes the JSON Patch operation that could not be applied. It
+// matches ErrPatchFailed with errors.Is.
+type PatchError struct {
+	Index  int
+	Op     string
+	Path   string
+	Reason string
+}
+
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("patch operation %d (%v %v) failed: %v", e.Index, e.Op, e.Path, e.Reason)
+}
+
+func (e *PatchError) Is(target error) bool {
+	return target == ErrPatchFailed
+}
+
+// PatchOperation is a single RFC 6902 JSON Patch operation. A patch document
+// can be decoded directly into a []PatchOperation.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped tokens. The
+// empty pointer refers to the whole document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// patchStep is one step of the patch pipeline. Each step reads the document d
+// and value v of the previous step and records the first failed operation.
+type patchStep struct {
+	index int
+	check string
+	doc   string
+	value string
+}
+
+// convertPatch builds the pipeline of steps for the operations. Move and copy
+// take two steps, the first reads the value at from into v and the second adds
+// it at path.
+func (qc *PgQueryConverter) convertPatch(ops []PatchOperation) ([]patchStep, error) {
+	textArr := func(v []string) string { return qc.arg(v) + "::text[]" }
+
+	add := func(i int, path []string, value string) patchStep {
+		if len(path) == 0 {
+			return patchStep{index: i, check: "true", doc: value}
+		}
+		p := textArr(path)
+		parent := textArr(path[:len(path)-1])
+		last := qc.arg(path[len(path)-1]) + "::text"
+		return patchStep{
+			index: i,
+			check: fmt.Sprintf(`CASE jsonb_typeof(d #> %[1]v) WHEN 'object' THEN true
+				WHEN 'array' THEN CASE WHEN %[2]v = '-' THEN true
+					WHEN %[2]v ~ '^[0-9]{1,9}$' THEN %[2]v::int <= jsonb_array_length(d #> %[1]v)
+					ELSE false END
+				ELSE false END`, parent, last),
+			doc: fmt.Sprintf(`CASE WHEN jsonb_typeof(d #> %[1]v) = 'object' THEN jsonb_set(d, %[3]v, %[4]v, true)
+				ELSE jsonb_insert(d, %[1]v || CASE WHEN %[2]v = '-' THEN jsonb_array_length(d #> %[1]v)::text ELSE %[2]v END, %[4]v) END`,
+				parent, last, p, value),
+		}
+	}
+
+	var steps []patchStep
+	for i, op := range ops {
+		fail := func(reason string) error {
+			return &PatchError{Index: i, Op: op.Op, Path: op.Path, Reason: reason}
+		}
+
+		path, err := parsePointer(op.Path)
+		if err != nil {
+			return nil, fail(err.Error())
+		}
+		var value string
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, fail("missing value")
+			}
+			value = qc.arg(string(op.Value)) + "::jsonb"
+		}
+
+		switch op.Op {
+		case "add":
+			steps = append(steps, add(i, path, value))
+		case "remove":
+			if len(path) == 0 {
+				return nil, fail("can not remove the whole document")
+			}
+			p := textArr(path)
+			steps = append(steps, patchStep{index: i, check: fmt.Sprintf("d #> %v IS NOT NULL", p), doc: fmt.Sprintf("d #- %v", p)})
+		case "replace":
+			if len(path) == 0 {
+				steps = append(steps, patchStep{index: i, check: "true", doc: value})
+				break
+			}
+			p := textArr(path)
+			steps = append(steps, patchStep{index: i, check: fmt.Sprintf("d #> %v IS NOT NULL", p), doc: fmt.Sprintf("jsonb_set(d, %v, %v, false)", p, value)})
+		case "test":
+			steps = append(steps, patchStep{index: i, check: fmt.Sprintf("d #> %v = %v", textArr(path), value), doc: "d"})
+		case "move", "copy":
+			from, err := parsePointer(op.From)
+			if err != nil {
+				return nil, fail(err.Error())
+			}
+			if op.Op == "move" && len(from) == 0 {
+				return nil, fail("can not move the whole document")
+			}
+			if op.Op == "move" && strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, fail("can not move a value into itself")
+			}
+			f := textArr(from)
+			read := patchStep{index: i, check: fmt.Sprintf("d #> %v IS NOT NULL", f), doc: "d", value: fmt.Sprintf("d #> %v", f)}
+			if op.Op == "move" {
+				read.doc = fmt.Sprintf("d #- %v", f)
+			}
+			steps = append(steps, read, add(i, path, "v"))
+		default:
+			return nil, fail("unknown operation")
+		}
+	}
+	return steps, nil
+}
+
+// Patch applies an RFC 6902 JSON Patch to the stored document in a single
+// statement and returns the updated document. The operations are applied in
+// order and if any of them fails (a missing path or a failed test) nothing is
+// changed and a PatchError naming the operation is returned. The version and
+// last updated time are bumped like Save does.
+func (ds *JsonDataStore[T]) Patch(ctx context.Context, key string, ops []PatchOperation) (*T, error) {
+	qc := ds.converter()
+	qc.arg(key)
+	steps, err := qc.convertPatch(ops)
+	if err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "WITH s0 AS (SELECT id, %v AS d, NULL::jsonb AS v, NULL::int AS failed FROM %v WHERE id = $1%v FOR UPDATE)",
+		qc.asJsonb("data"), ds.table, ds.andVisible())
+	for i, step := range steps {
+		value := "v"
+		if step.value != "" {
+			value = fmt.Sprintf("CASE WHEN failed IS NULL THEN %v END", step.value)
+		}
+		fmt.Fprintf(&sb, `, s%[1]v AS (SELECT id,
+			CASE WHEN failed IS NULL AND (%[3]v) THEN %[4]v ELSE d END AS d,
+			%[5]v AS v,
+			CASE WHEN failed IS NULL AND NOT COALESCE(%[3]v, false) THEN %[6]v ELSE failed END AS failed
+			FROM s%[2]v)`, i+1, i, step.check, step.doc, value, step.index)
+	}
+	last := fmt.Sprintf("s%v", len(steps))
+	fmt.Fprintf(&sb, `, updated AS (UPDATE %[1]v AS t SET data = %[2]v.d%[3]v, version = t.version + 1, last_updated = CURRENT_TIMESTAMP
+		FROM %[2]v WHERE t.id = %[2]v.id AND %[2]v.failed IS NULL
+		RETURNING t.data)
+		SELECT failed, (SELECT data FROM updated) FROM %[2]v`, ds.table, last, ds.dataCast())
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	var failed *int
+	var jsonResult []byte
+	err = conn.QueryRow(ctx, sb.String(), qc.args...).Scan(&failed, &jsonResult)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, notFoundError("patch", ds.table, key)
+		}
+		return nil, ds.wrapErr("patch", key, err)
+	}
+	if failed != nil {
+		op := ops[*failed]
+		reason := "path does not exist"
+		if op.Op == "test" {
+			reason = "value does not match"
+		}
+		return nil, &PatchError{Index: *failed, Op: op.Op, Path: op.Path, Reason: reason}
+	}
+	return fromByte[T](jsonResult)
+}
+
+// isJsonNull reports if the raw JSON is the null literal
+func isJsonNull(raw json.RawMessage) bool {
+	return bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+}
+
+// convertMergePatch builds the RFC 7396 merge of the patch into the target
+// expression. Objects are merged key by key, null removes a key and any other
+// value replaces the target.
+func (qc *PgQueryConverter) convertMergePatch(target string, patch json.RawMessage) (string, error) {
+	trimmed := bytes.TrimSpace(patch)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return qc.arg(string(patch)) + "::jsonb", nil
+	}
+
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &members); err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(members))
+	for k := range members {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	obj := fmt.Sprintf(`COALESCE(jsonb_path_query_first(%v, '$ ? (@.type() == "object")'), '{}'::jsonb)`, target)
+	var removed []string
+	var set []string
+	for _, k := range keys {
+		if isJsonNull(members[k]) {
+			removed = append(removed, k)
+			continue
+		}
+		name := qc.arg(k) + "::text"
+		value, err := qc.convertMergePatch(fmt.Sprintf("(%v -> %v)", obj, name), members[k])
+		if err != nil {
+			return "", err
+		}
+		set = append(set, name, value)
+	}
+
+	expr := obj
+	if len(removed) > 0 {
+		expr = fmt.Sprintf("(%v - %v::text[])", expr, qc.arg(removed))
+	}
+	if len(set) > 0 {
+		expr = fmt.Sprintf("(%v || jsonb_build_object(%v))", expr, strings.Join(set, ", "))
+	}
+	return expr, nil
+}
+
+// MergePatch applies an RFC 7396 JSON Merge Patch to the stored document in a
+// single statement and returns the updated document. The version and last
+// updated time are bumped like Save does.
+func (ds *JsonDataStore[T]) MergePatch(ctx context.Context, key string, patch []byte) (*T, error) {
+	qc := ds.converter()
+	qc.arg(key)
+	expr, err := qc.convertMergePatch(qc.asJsonb("data"), patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid merge patch, %v", ErrPatchFailed, err)
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	sqlPatch := fmt.Sprintf(`UPDATE %v SET data = (%v)%v, version = version + 1, last_updated = CURRENT_TIMESTAMP
+		WHERE id = $1%v
+		RETURNING data`, ds.table, expr, ds.dataCast(), ds.andVisible())
+
+	var jsonResult []byte
+	err = conn.QueryRow(ctx, sqlPatch, qc.args...).Scan(&jsonResult)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, notFoundError("patch", ds.table, key)
+		}
+		return nil, ds.wrapErr("patch", key, err)
+	}
+	return fromByte[T](jsonResult)
+}
@@ -0,0 +1,119 @@
+package cloudypg
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePointer(t *testing.T) {
+	tokens, err := parsePointer("/a~1b/c~0d/0")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/b", "c~d", "0"}, tokens)
+
+	tokens, err = parsePointer("")
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+
+	_, err = parsePointer("a/b")
+	require.Error(t, err)
+}
+
+func TestConvertPatchErrors(t *testing.T) {
+	for _, ops := range [][]PatchOperation{
+		{{Op: "add", Path: "/a"}},
+		{{Op: "remove", Path: ""}},
+		{{Op: "move", From: "/a", Path: "/a/b"}},
+		{{Op: "rename", Path: "/a"}},
+		{{Op: "test", Path: "a", Value: json.RawMessage(`1`)}},
+	} {
+		_, err := new(PgQueryConverter).convertPatch(ops)
+		require.ErrorIs(t, err, ErrPatchFailed)
+	}
+}
+
+func TestConvertMergePatch(t *testing.T) {
+	qc := &PgQueryConverter{jsonb: true}
+	sql, err := qc.convertMergePatch("data", json.RawMessage(`{"b": null, "a": {"c": 1}}`))
+	require.NoError(t, err)
+	obj := `COALESCE(jsonb_path_query_first(data, '$ ? (@.type() == "object")'), '{}'::jsonb)`
+	nested := `COALESCE(jsonb_path_query_first((` + obj + ` -> $1::text), '$ ? (@.type() == "object")'), '{}'::jsonb)`
+	require.Equal(t, "(("+obj+" - $4::text[]) || jsonb_build_object($1::text, ("+nested+" || jsonb_build_object($2::text, $3::jsonb))))", sql)
+	require.Equal(t, []any{"a", "c", "1", []string{"b"}}, qc.args)
+}
+
+func TestJsonDatastorePatch(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[map[string]any](ctx, p, "patchitems")
+	require.NoError(t, ds.Open(ctx, nil))
+
+	doc := map[string]any{"name": "one", "tags": []any{"a"}, "nested": map[string]any{"x": 1.0, "y": 2.0}}
+	require.NoError(t, ds.Save(ctx, &doc, "1"))
+
+	t.Run("MergePatch", func(t *testing.T) {
+		item, err := ds.MergePatch(ctx, "1", []byte(`{"name": "two", "nested": {"x": null, "z": 3}, "extra": {"deep": true}}`))
+		require.NoError(t, err)
+		require.Equal(t, map[string]any{
+			"name":   "two",
+			"tags":   []any{"a"},
+			"nested": map[string]any{"y": 2.0, "z": 3.0},
+			"extra":  map[string]any{"deep": true},
+		}, *item)
+
+		meta, err := ds.GetMetadata(ctx, "1")
+		require.NoError(t, err)
+		require.Equal(t, int64(2), meta[0].Version)
+
+		_, err = ds.MergePatch(ctx, "missing", []byte(`{"name": "x"}`))
+		require.Error(t, err)
+	})
+
+	t.Run("JsonPatch", func(t *testing.T) {
+		var ops []PatchOperation
+		require.NoError(t, json.Unmarshal([]byte(`[
+			{"op": "test", "path": "/name", "value": "two"},
+			{"op": "add", "path": "/tags/-", "value": "b"},
+			{"op": "add", "path": "/tags/0", "value": "first"},
+			{"op": "replace", "path": "/name", "value": "three"},
+			{"op": "copy", "from": "/nested/y", "path": "/copied"},
+			{"op": "move", "from": "/extra", "path": "/nested/extra"},
+			{"op": "remove", "path": "/nested/z"}
+		]`), &ops))
+
+		item, err := ds.Patch(ctx, "1", ops)
+		require.NoError(t, err)
+		require.Equal(t, map[string]any{
+			"name":   "three",
+			"tags":   []any{"first", "a", "b"},
+			"nested": map[string]any{"y": 2.0, "extra": map[string]any{"deep": true}},
+			"copied": 2.0,
+		}, *item)
+	})
+
+	t.Run("MissingPath", func(t *testing.T) {
+		before, err := ds.Get(ctx, "1")
+		require.NoError(t, err)
+
+		_, err = ds.Patch(ctx, "1", []PatchOperation{
+			{Op: "replace", Path: "/name", Value: json.RawMessage(`"four"`)},
+			{Op: "remove", Path: "/nope/deeper"},
+		})
+		var patchErr *PatchError
+		require.ErrorAs(t, err, &patchErr)
+		require.Equal(t, 1, patchErr.Index)
+
+		_, err = ds.Patch(ctx, "1", []PatchOperation{{Op: "test", Path: "/name", Value: json.RawMessage(`"other"`)}})
+		require.ErrorIs(t, err, ErrPatchFailed)
+
+		after, err := ds.Get(ctx, "1")
+		require.NoError(t, err)
+		require.Equal(t, before, after)
+	})
+}
@@ -0,0 +1,130 @@
+package cloudypg
+
+import (
+	"errors"
+	"fmt"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/appliedres/cloudy/datastore"
+)
+
+// Pattern matching condition types. The data of each is the field followed by
+// the pattern.
+const (
+	LikeConditionType   = "like"
+	ILikeConditionType  = "ilike"
+	RegexConditionType  = "regex"
+	IRegexConditionType = "iregex"
+)
+
+// likeEscaper escapes the LIKE wildcards and the escape character itself
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// EscapeLike escapes the wildcards in the value so it matches literally in a
+// LIKE pattern
+func EscapeLike(value string) string {
+	return likeEscaper.Replace(value)
+}
+
+// Like adds a condition matching the field against a LIKE pattern, where "%"
+// matches any text and "_" any single character. A backslash escapes the next
+// character, use EscapeLike to match user supplied text literally.
+func Like(cg *datastore.SimpleQueryConditionGroup, field string, pattern string) {
+	addPattern(cg, LikeConditionType, field, pattern)
+}
+
+// ILike is the case insensitive version of Like
+func ILike(cg *datastore.SimpleQueryConditionGroup, field string, pattern string) {
+	addPattern(cg, ILikeConditionType, field, pattern)
+}
+
+// StartsWith adds a condition matching the fields that start with the prefix
+func StartsWith(cg *datastore.SimpleQueryConditionGroup, field string, prefix string, ignoreCase bool) {
+	addPattern(cg, likeType(ignoreCase), field, EscapeLike(prefix)+"%")
+}
+
+// EndsWith adds a condition matching the fields that end with the suffix
+func EndsWith(cg *datastore.SimpleQueryConditionGroup, field string, suffix string, ignoreCase bool) {
+	addPattern(cg, likeType(ignoreCase), field, "%"+EscapeLike(suffix))
+}
+
+// ContainsText adds a condition matching the fields that contain the text
+func ContainsText(cg *datastore.SimpleQueryConditionGroup, field string, text string, ignoreCase bool) {
+	addPattern(cg, likeType(ignoreCase), field, "%"+EscapeLike(text)+"%")
+}
+
+// MatchesRegex adds a condition matching the field against a POSIX regular
+// expression. An expression that does not parse is reported as an invalid
+// query before anything is sent to the database.
+func MatchesRegex(cg *datastore.SimpleQueryConditionGroup, field string, pattern string, ignoreCase bool) {
+	typ := RegexConditionType
+	if ignoreCase {
+		typ = IRegexConditionType
+	}
+	addPattern(cg, typ, field, pattern)
+}
+
+func likeType(ignoreCase bool) string {
+	if ignoreCase {
+		return ILikeConditionType
+	}
+	return LikeConditionType
+}
+
+func addPattern(cg *datastore.SimpleQueryConditionGroup, typ string, field string, pattern string) {
+	cg.Conditions = append(cg.Conditions, &datastore.SimpleQueryCondition{
+		Type: typ,
+		Data: []string{field, pattern},
+	})
+}
+
+// validLikePattern checks the pattern does not end with a lone escape
+// character, which PostgreSQL rejects
+func validLikePattern(pattern string) bool {
+	escaped := false
+	for _, r := range pattern {
+		escaped = !escaped && r == '\\'
+	}
+	return !escaped
+}
+
+// checkRegex parses the regular expression and returns the syntax errors that
+// PostgreSQL reports as well. Escapes and groups Go does not know, such as back
+// references and lookahead, are left for the database to check.
+func checkRegex(pattern string) error {
+	_, err := syntax.Parse(pattern, syntax.Perl)
+	var syntaxErr *syntax.Error
+	if errors.As(err, &syntaxErr) {
+		switch syntaxErr.Code {
+		case syntax.ErrInvalidEscape, syntax.ErrInvalidPerlOp, syntax.ErrInvalidNamedCapture,
+			syntax.ErrNestingDepth, syntax.ErrLarge:
+			return nil
+		}
+	}
+	return err
+}
+
+func (qc *PgQueryConverter) convertPattern(c *datastore.SimpleQueryCondition) string {
+	if len(c.Data) != 2 {
+		return qc.fail("%v condition needs a field and a pattern", c.Type)
+	}
+	field, pattern := qc.toField(c.Data[0]), c.Data[1]
+
+	switch c.Type {
+	case LikeConditionType, ILikeConditionType:
+		if !validLikePattern(pattern) {
+			return qc.fail("%v pattern %q ends with an escape character", c.Type, pattern)
+		}
+		return fmt.Sprintf(`(%v) %v %v ESCAPE '\'`, field, strings.ToUpper(c.Type), qc.arg(pattern))
+	}
+
+	if err := checkRegex(pattern); err != nil {
+		return qc.fail("%v pattern: %v", c.Type, err)
+	}
+	op := "~"
+	if c.Type == IRegexConditionType {
+		op = "~*"
+	}
+	return fmt.Sprintf("(%v) %v %v", field, op, qc.arg(pattern))
+}
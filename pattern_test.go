@@ -0,0 +1,119 @@
+package cloudypg
+
+import (
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertPatternConditions(t *testing.T) {
+	q := datastore.NewQuery()
+	StartsWith(q.Conditions, "name", "50%_off", true)
+	ContainsText(q.Conditions, "path", `C:\temp`, false)
+	MatchesRegex(q.Conditions, "code", "^[A-Z]{3}$", false)
+	MatchesRegex(q.Conditions, "code", "^abc", true)
+
+	qc := new(PgQueryConverter)
+	sql, args := qc.ConvertWithArgs(q, "testitems")
+	require.NoError(t, qc.Err())
+	require.Equal(t, `SELECT data FROM testitems WHERE (data->>'name') ILIKE $1 ESCAPE '\' and (data->>'path') LIKE $2 ESCAPE '\' and (data->>'code') ~ $3 and (data->>'code') ~* $4`, sql)
+	require.Equal(t, []any{`50\%\_off%`, `%C:\\temp%`, "^[A-Z]{3}$", "^abc"}, args)
+}
+
+func TestConvertInvalidConditions(t *testing.T) {
+	tests := map[string]*datastore.SimpleQueryCondition{
+		"Unknown":        {Type: "soundslike", Data: []string{"name", "x"}},
+		"Lone Escape":    {Type: LikeConditionType, Data: []string{"name", `abc\`}},
+		"Missing Values": {Type: RegexConditionType, Data: []string{"name"}},
+		"Missing Date":   {Type: "before", Data: []string{"created"}},
+		"Bad Regex":      {Type: RegexConditionType, Data: []string{"name", "(abc"}},
+		"Bad IRegex":     {Type: IRegexConditionType, Data: []string{"name", "[a-"}},
+		"Short Eq":       {Type: "eq", Data: []string{"name"}},
+		"Short Between":  {Type: "between", Data: []string{"count", "1"}},
+		"No Field":       {Type: "null"},
+		"Bad Date":       {Type: "after", Data: []string{"created"}, DataMap: map[string]any{"value": "yesterday"}},
+		"Bad Includes":   {Type: "includes", Data: []string{"tags"}, DataMap: map[string]any{"value": []any{"a", 1}}},
+		"Bad AnyIn":      {Type: "anyin", Data: []string{"tags"}, DataMap: map[string]any{"value": "a"}},
+	}
+	for name, c := range tests {
+		t.Run(name, func(t *testing.T) {
+			q := datastore.NewQuery()
+			q.Conditions.Conditions = append(q.Conditions.Conditions, c)
+
+			qc := new(PgQueryConverter)
+			sql, _ := qc.ConvertWithArgs(q, "testitems")
+			require.ErrorIs(t, qc.Err(), ErrInvalidQuery)
+			require.NotContains(t, sql, "UNKNOWN")
+
+			// The next conversion starts clean
+			qc.ConvertWithArgs(datastore.NewQuery(), "testitems")
+			require.NoError(t, qc.Err())
+		})
+	}
+
+	require.True(t, validLikePattern(`a\\`))
+	require.True(t, validLikePattern(`a\%`))
+	require.False(t, validLikePattern(`a\\\`))
+
+	// Syntax only PostgreSQL knows is left to the database
+	require.NoError(t, checkRegex(`(a)\1`))
+	require.NoError(t, checkRegex(`\mword\M`))
+	require.NoError(t, checkRegex(`foo(?=bar)`))
+	require.Error(t, checkRegex(`a{2`+`,1}`))
+	require.Error(t, checkRegex(`*a`))
+}
+
+func TestJsonDatastorePatternConditions(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems")
+	require.NoError(t, ds.Open(ctx, nil))
+
+	for _, item := range []*TestItem{
+		{ID: "1", Name: "Alice"},
+		{ID: "2", Name: "alfred"},
+		{ID: "3", Name: "100% Bob"},
+		{ID: "4", Name: "1000 Bobs"},
+	} {
+		require.NoError(t, ds.Save(ctx, item, item.ID))
+	}
+
+	count := func(t *testing.T, add func(q *datastore.SimpleQuery)) int {
+		q := datastore.NewQuery()
+		add(q)
+		found, err := ds.Query(ctx, q)
+		require.NoError(t, err)
+		return len(found)
+	}
+
+	require.Equal(t, 1, count(t, func(q *datastore.SimpleQuery) { StartsWith(q.Conditions, "name", "al", false) }))
+	require.Equal(t, 2, count(t, func(q *datastore.SimpleQuery) { StartsWith(q.Conditions, "name", "AL", true) }))
+	require.Equal(t, 1, count(t, func(q *datastore.SimpleQuery) { StartsWith(q.Conditions, "name", "100%", false) }))
+	require.Equal(t, 2, count(t, func(q *datastore.SimpleQuery) { ILike(q.Conditions, "name", "%bob%") }))
+	require.Equal(t, 1, count(t, func(q *datastore.SimpleQuery) { EndsWith(q.Conditions, "name", "bobs", true) }))
+	require.Equal(t, 2, count(t, func(q *datastore.SimpleQuery) { MatchesRegex(q.Conditions, "name", "^al", true) }))
+
+	t.Run("Invalid Regex", func(t *testing.T) {
+		q := datastore.NewQuery()
+		MatchesRegex(q.Conditions, "name", "(", false)
+		_, err := ds.Query(ctx, q)
+		require.ErrorIs(t, err, ErrInvalidQuery)
+	})
+
+	t.Run("Unknown Condition", func(t *testing.T) {
+		q := datastore.NewQuery()
+		q.Conditions.Conditions = append(q.Conditions.Conditions, &datastore.SimpleQueryCondition{Type: "soundslike", Data: []string{"name", "x"}})
+		_, err := ds.Query(ctx, q)
+		require.ErrorIs(t, err, ErrInvalidQuery)
+
+		for _, err := range ds.StreamQuery(ctx, q) {
+			require.ErrorIs(t, err, ErrInvalidQuery)
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package cloudypg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// KeyedItem is a document along with its key
+type KeyedItem[T any] struct {
+	Key  string
+	Item *T
+}
+
+// QueryAndSaveOption changes how QueryAndSave locks the rows it reads
+type QueryAndSaveOption func(opts *queryAndSaveOptions)
+
+type queryAndSaveOptions struct {
+	skipLocked bool
+}
+
+// SkipLocked leaves out the rows another transaction has locked instead of
+// waiting for them. Workers running the same query each claim a disjoint set
+// of rows this way.
+func SkipLocked() QueryAndSaveOption {
+	return func(opts *queryAndSaveOptions) {
+		opts.skipLocked = true
+	}
+}
+
+// WithKeyFunc tells the datastore how to get the key of a document. It is used
+// by QueryAndSaveItems to know where to write the updated documents.
+func WithKeyFunc[T any](fn func(item *T) string) JsonDataStoreOption {
+	return func(opts *jsonDataStoreOptions) {
+		opts.keyFn = fn
+	}
+}
+
+// ConvertLockWithArgs converts the query into a SELECT of the id and data of
+// the matching rows that locks them for update. Recursive queries can not be
+// locked and the RecurseConfig is ignored.
+func (qc *PgQueryConverter) ConvertLockWithArgs(q *datastore.SimpleQuery, table string, skipLocked bool) (string, []any) {
+	qc.reset()
+
+	sql := fmt.Sprintf("SELECT id, data FROM %s", table)
+	where := qc.convertWhere(q.Conditions)
+	if where != "" {
+		sql += fmt.Sprintf(" WHERE %s", where)
+	}
+	sort := qc.ConvertSort(q.SortBy)
+	if sort != "" {
+		sql += fmt.Sprintf(" ORDER BY %s", sort)
+	}
+	if q.Size > 0 {
+		sql += fmt.Sprintf(" LIMIT %v", q.Size)
+	}
+	if q.Offset > 0 {
+		sql += fmt.Sprintf(" OFFSET %v", q.Offset)
+	}
+
+	sql += " FOR UPDATE"
+	if skipLocked {
+		sql += " SKIP LOCKED"
+	}
+	return sql, qc.args
+}
+
+// QueryAndSave locks the rows matching the query, passes them to the updater
+// and writes the documents it returns back in the same transaction, bumping
+// their version and last updated time. Only the returned documents are
+// written. A returned key that does not exist fails the whole call with
+// ErrNotFound and nothing is written. The updater runs with the transaction in
+// its context so other datastore calls made with it join the transaction. The
+// written documents are returned.
+func (ds *JsonDataStore[T]) QueryAndSave(ctx context.Context, query *datastore.SimpleQuery, updater func(ctx context.Context, items []*KeyedItem[T]) ([]*KeyedItem[T], error), opts ...QueryAndSaveOption) ([]*KeyedItem[T], error) {
+	var o queryAndSaveOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	qc := ds.converter()
+	sql, args := qc.ConvertLockWithArgs(query, ds.table, o.skipLocked)
+	if err := qc.Err(); err != nil {
+		return nil, err
+	}
+
+	var updated []*KeyedItem[T]
+	var updaterErr error
+
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, sql, args...)
+		if err != nil {
+			return ds.wrapErr("query and save", "", err)
+		}
+		found, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*KeyedItem[T], error) {
+			var key string
+			var jsonResult []byte
+			if err := row.Scan(&key, &jsonResult); err != nil {
+				return nil, err
+			}
+			item, err := fromByte[T](jsonResult)
+			if err != nil {
+				return nil, err
+			}
+			return &KeyedItem[T]{Key: key, Item: item}, nil
+		})
+		if err != nil {
+			return ds.wrapErr("query and save", "", err)
+		}
+
+		updated, updaterErr = updater(withTx(ctx, ds.provider, tx), found)
+		if updaterErr != nil {
+			return updaterErr
+		}
+
+		var missing []string
+		for _, ki := range updated {
+			ok, err := ds.update(ctx, tx, ki.Item, ki.Key)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				missing = append(missing, ki.Key)
+			}
+		}
+		if len(missing) > 0 {
+			return notFoundError("query and save", ds.table, strings.Join(missing, ", "))
+		}
+		return nil
+	})
+	if err != nil && err == updaterErr {
+		return nil, err
+	}
+	if err != nil {
+		return nil, ds.wrapErr("query and save", "", err)
+	}
+	return updated, nil
+}
+
+// QueryAndSaveItems is QueryAndSave for updaters that work on the documents
+// alone. The keys of the returned documents come from the function given with
+// WithKeyFunc.
+func (ds *JsonDataStore[T]) QueryAndSaveItems(ctx context.Context, query *datastore.SimpleQuery, updater func(ctx context.Context, items []*T) ([]*T, error), opts ...QueryAndSaveOption) ([]*T, error) {
+	keyFn, ok := ds.opts.keyFn.(func(item *T) string)
+	if !ok {
+		return nil, errors.New("no key function configured, use WithKeyFunc")
+	}
+
+	saved, err := ds.QueryAndSave(ctx, query, func(ctx context.Context, found []*KeyedItem[T]) ([]*KeyedItem[T], error) {
+		items := make([]*T, len(found))
+		for i, ki := range found {
+			items[i] = ki.Item
+		}
+		updated, err := updater(ctx, items)
+		if err != nil {
+			return nil, err
+		}
+		keyed := make([]*KeyedItem[T], len(updated))
+		for i, item := range updated {
+			keyed[i] = &KeyedItem[T]{Key: keyFn(item), Item: item}
+		}
+		return keyed, nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	rtn := make([]*T, len(saved))
+	for i, ki := range saved {
+		rtn[i] = ki.Item
+	}
+	return rtn, nil
+}
@@ -0,0 +1,103 @@
+package cloudypg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertLockWithArgs(t *testing.T) {
+	q := datastore.NewQuery()
+	q.Conditions.Equals("name", "a")
+	q.Size = 5
+
+	sql, args := new(PgQueryConverter).ConvertLockWithArgs(q, "testitems", false)
+	require.Equal(t, "SELECT id, data FROM testitems WHERE (data->>'name') = $1 LIMIT 5 FOR UPDATE", sql)
+	require.Equal(t, []any{"a"}, args)
+
+	sql, _ = new(PgQueryConverter).ConvertLockWithArgs(q, "testitems", true)
+	require.Equal(t, "SELECT id, data FROM testitems WHERE (data->>'name') = $1 LIMIT 5 FOR UPDATE SKIP LOCKED", sql)
+}
+
+func TestJsonDatastoreQueryAndSave(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems", WithKeyFunc(func(item *TestItem) string { return item.ID }))
+	require.NoError(t, ds.Open(ctx, nil))
+
+	for _, id := range []string{"1", "2", "3"} {
+		require.NoError(t, ds.Save(ctx, &TestItem{ID: id, Name: "pending"}, id))
+	}
+
+	q := datastore.NewQuery()
+	q.Conditions.Equals("name", "pending")
+
+	t.Run("Keyed", func(t *testing.T) {
+		saved, err := ds.QueryAndSave(ctx, q, func(ctx context.Context, items []*KeyedItem[TestItem]) ([]*KeyedItem[TestItem], error) {
+			require.Len(t, items, 3)
+			items[0].Item.Name = "claimed"
+			return items[:1], nil
+		})
+		require.NoError(t, err)
+		require.Len(t, saved, 1)
+
+		meta, err := ds.GetMetadata(ctx, saved[0].Key)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), meta[0].Version)
+	})
+
+	t.Run("Key Func", func(t *testing.T) {
+		saved, err := ds.QueryAndSaveItems(ctx, q, func(ctx context.Context, items []*TestItem) ([]*TestItem, error) {
+			for _, item := range items {
+				item.Name = "done"
+			}
+			return items, nil
+		})
+		require.NoError(t, err)
+		require.Len(t, saved, 2)
+
+		cnt, err := ds.Count(ctx, q)
+		require.NoError(t, err)
+		require.Equal(t, 0, cnt)
+	})
+
+	t.Run("Missing Key", func(t *testing.T) {
+		q := datastore.NewQuery()
+		q.Conditions.Equals("id", "1")
+		_, err := ds.QueryAndSave(ctx, q, func(ctx context.Context, items []*KeyedItem[TestItem]) ([]*KeyedItem[TestItem], error) {
+			return append(items, &KeyedItem[TestItem]{Key: "missing", Item: &TestItem{ID: "missing"}}), nil
+		})
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("Skip Locked", func(t *testing.T) {
+		all := datastore.NewQuery()
+		err := RunInTx(ctx, p, func(txCtx context.Context) error {
+			// Lock row 1 in this transaction, a second worker then skips it
+			one := datastore.NewQuery()
+			one.Conditions.Equals("id", "1")
+			_, err := ds.QueryAndSave(txCtx, one, func(ctx context.Context, items []*KeyedItem[TestItem]) ([]*KeyedItem[TestItem], error) {
+				return nil, nil
+			})
+			if err != nil {
+				return err
+			}
+
+			_, err = ds.QueryAndSave(ctx, all, func(ctx context.Context, items []*KeyedItem[TestItem]) ([]*KeyedItem[TestItem], error) {
+				for _, ki := range items {
+					require.NotEqual(t, "1", ki.Key)
+				}
+				return nil, nil
+			}, SkipLocked())
+			return err
+		})
+		require.NoError(t, err)
+	})
+}
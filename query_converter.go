@@ -1,7 +1,10 @@
 package cloudypg
 
 import (
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -9,13 +12,79 @@ import (
 	"github.com/appliedres/cloudy/datastore"
 )
 
+// PgQueryConverter turns a SimpleQuery into PostgreSQL. Condition values are
+// never written into the SQL, instead each one is collected as an argument and
+// referenced with a $n placeholder.
 type PgQueryConverter struct {
+	args []any
+
+	// filter is always added to the conditions, it is used by the datastore
+	// to hide soft deleted rows
+	filter string
+
+	// jsonb is set when the data column is JSONB, so JSON values do not need
+	// to be cast before using the JSONB operators
+	jsonb bool
+
+	// err is the first invalid condition found by the last conversion
+	err error
+
+	// fields maps names that are not document fields, such as aggregates, to
+	// their expressions
+	fields map[string]string
 }
 
+// Convert returns the query as a single SQL string with the arguments inlined.
+// This is meant for logging and debugging only, use ConvertWithArgs to build
+// statements that are executed.
 func (qc *PgQueryConverter) Convert(q *datastore.SimpleQuery, table string) string {
+	sql, args := qc.ConvertWithArgs(q, table)
+	return inlineArgs(sql, args)
+}
+
+// ConvertDelete returns the delete statement as a single SQL string with the
+// arguments inlined. This is meant for logging and debugging only, use
+// ConvertDeleteWithArgs to build statements that are executed.
+func (qc *PgQueryConverter) ConvertDelete(q *datastore.SimpleQuery, table string) string {
+	sql, args := qc.ConvertDeleteWithArgs(q, table)
+	return inlineArgs(sql, args)
+}
+
+// Args returns the arguments collected so far, in placeholder order
+func (qc *PgQueryConverter) Args() []any {
+	return qc.args
+}
+
+// Err returns the error for the first unknown or malformed condition found by
+// the last conversion, or nil when the query is valid. The statement must not
+// be executed when it is set.
+func (qc *PgQueryConverter) Err() error {
+	return qc.err
+}
+
+// fail records the invalid condition and returns a condition that matches
+// nothing, so the statement stays well formed
+func (qc *PgQueryConverter) fail(format string, a ...any) string {
+	if qc.err == nil {
+		qc.err = &Error{Op: "convert query", Kind: ErrInvalidQuery, Err: fmt.Errorf(format, a...)}
+	}
+	return "FALSE"
+}
+
+// reset clears the arguments and error of the last conversion
+func (qc *PgQueryConverter) reset(args ...any) {
+	qc.args = args
+	qc.err = nil
+}
+
+// ConvertWithArgs converts the query into a SQL statement with $n placeholders
+// along with the ordered arguments for those placeholders.
+func (qc *PgQueryConverter) ConvertWithArgs(q *datastore.SimpleQuery, table string) (string, []any) {
+	qc.reset()
+
 	// Build Basic Query
 	sql := qc.ConvertSelect(q, table)
-	where := qc.ConvertConditionGroup(q.Conditions)
+	where := qc.convertWhere(q.Conditions)
 	if where != "" {
 		sql += fmt.Sprintf(" WHERE %s", where)
 	}
@@ -31,7 +100,7 @@ func (qc *PgQueryConverter) Convert(q *datastore.SimpleQuery, table string) stri
 	}
 
 	if q.RecurseConfig == nil {
-		return sql
+		return sql, qc.args
 	}
 
 	// Build Recursive Query
@@ -45,49 +114,74 @@ func (qc *PgQueryConverter) Convert(q *datastore.SimpleQuery, table string) stri
 		SELECT t.data
 		FROM {TABLE} t
 		JOIN hierarchy h ON t.{ID} = h.{PARENT}
+		{WHERE}
 	)
 	SELECT data FROM hierarchy`
 
+	recurseWhere := ""
+	if qc.filter != "" {
+		recurseWhere = "WHERE " + qc.filter
+	}
+
 	sqlFixed := strings.ReplaceAll(sqlRecurse, "{SQL}", sql)
+	sqlFixed = strings.ReplaceAll(sqlFixed, "{WHERE}", recurseWhere)
 	sqlFixed = strings.ReplaceAll(sqlFixed, "{TABLE}", table)
 	sqlFixed = strings.ReplaceAll(sqlFixed, "{ID}", qc.toField(q.RecurseConfig.ToField))
 	sqlFixed = strings.ReplaceAll(sqlFixed, "{PARENT}", qc.toField(q.RecurseConfig.FromField))
 
-	return sqlFixed
+	return sqlFixed, qc.args
 }
 
-func (qc *PgQueryConverter) ConvertDelete(q *datastore.SimpleQuery, table string) string {
+// ConvertDeleteWithArgs converts the query into a DELETE statement with $n
+// placeholders along with the ordered arguments for those placeholders. The
+// statement returns the ids of the deleted rows.
+func (qc *PgQueryConverter) ConvertDeleteWithArgs(q *datastore.SimpleQuery, table string) (string, []any) {
+	qc.reset()
+
 	if q.RecurseConfig == nil {
-		where := qc.ConvertConditionGroup(q.Conditions)
+		where := qc.convertWhere(q.Conditions)
 		if where != "" {
-			return fmt.Sprintf("DELETE FROM %s WHERE %s", table, where)
+			return fmt.Sprintf("DELETE FROM %s WHERE %s RETURNING id", table, where), qc.args
 		}
-		return fmt.Sprintf("DELETE FROM %s", table)
+		return fmt.Sprintf("DELETE FROM %s RETURNING id", table), qc.args
 	}
 
-	// Recursive Delete
-	// 1. Build Recursive Query
+	return qc.convertHierarchy(q, table, fmt.Sprintf("DELETE FROM %s", table)), qc.args
+}
 
-	// Build Basic Query
-	sql := qc.ConvertSelect(q, table)
+// ConvertUpdateWithArgs converts the query into an UPDATE of every matching row
+// (and with RecurseConfig, every row in the hierarchy) that returns the ids of
+// the updated rows. The set clause may use placeholders for the setArgs, which
+// are numbered first.
+func (qc *PgQueryConverter) ConvertUpdateWithArgs(q *datastore.SimpleQuery, table string, set string, setArgs ...any) (string, []any) {
+	qc.reset(append([]any{}, setArgs...)...)
+
+	stmt := fmt.Sprintf("UPDATE %s SET %s", table, set)
+	if q.RecurseConfig == nil {
+		where := qc.convertWhere(q.Conditions)
+		if where != "" {
+			stmt += fmt.Sprintf(" WHERE %s", where)
+		}
+		return stmt + " RETURNING id", qc.args
+	}
 
-	where := qc.ConvertConditionGroup(q.Conditions)
+	return qc.convertHierarchy(q, table, stmt), qc.args
+}
+
+// convertHierarchy builds a recursive query that collects the ids of the rows
+// matching the query and all the rows related to them through the
+// RecurseConfig, then runs the DELETE or UPDATE statement against those ids.
+func (qc *PgQueryConverter) convertHierarchy(q *datastore.SimpleQuery, table string, stmt string) string {
+	// Build Basic Query
+	sql := fmt.Sprintf("SELECT id, data FROM %s", table)
+	where := qc.convertWhere(q.Conditions)
 	if where != "" {
 		sql += fmt.Sprintf(" WHERE %s", where)
 	}
-	sort := qc.ConvertSort(q.SortBy)
-	if sort != "" {
-		sql += fmt.Sprintf(" ORDER BY %s", sort)
-	}
-	if q.Size > 0 {
-		sql += fmt.Sprintf(" LIMIT %v", q.Size)
-	}
-	if q.Offset > 0 {
-		sql += fmt.Sprintf(" OFFSET %v", q.Offset)
-	}
 
-	if q.RecurseConfig == nil {
-		return sql
+	recurseWhere := ""
+	if qc.filter != "" {
+		recurseWhere = "WHERE " + qc.filter
 	}
 
 	// Build Recursive Query
@@ -97,16 +191,19 @@ func (qc *PgQueryConverter) ConvertDelete(q *datastore.SimpleQuery, table string
 		
 		UNION ALL
 		
-		-- Recursive part: get parent rows
-		SELECT t.data
+		-- Recursive part: get related rows
+		SELECT t.id, t.data
 		FROM {TABLE} t
 		JOIN hierarchy h ON t.{ID} = h.{PARENT}
+		{WHERE}
 	)
-	DELETE FROM {TABLE}
-	WHERE ID IN (SELECT ID FROM hierarchy)
-	RETURNING ID`
+	{STMT}
+	WHERE id IN (SELECT id FROM hierarchy)
+	RETURNING id`
 
 	sqlFixed := strings.ReplaceAll(sqlRecurse, "{SQL}", sql)
+	sqlFixed = strings.ReplaceAll(sqlFixed, "{STMT}", stmt)
+	sqlFixed = strings.ReplaceAll(sqlFixed, "{WHERE}", recurseWhere)
 	sqlFixed = strings.ReplaceAll(sqlFixed, "{TABLE}", table)
 	sqlFixed = strings.ReplaceAll(sqlFixed, "{ID}", qc.toField(q.RecurseConfig.ToField))
 	sqlFixed = strings.ReplaceAll(sqlFixed, "{PARENT}", qc.toField(q.RecurseConfig.FromField))
@@ -114,13 +211,25 @@ func (qc *PgQueryConverter) ConvertDelete(q *datastore.SimpleQuery, table string
 	return sqlFixed
 }
 
+// convertWhere converts the conditions and adds the converter filter
+func (qc *PgQueryConverter) convertWhere(cg *datastore.SimpleQueryConditionGroup) string {
+	where := qc.ConvertConditionGroup(cg)
+	if qc.filter == "" {
+		return where
+	}
+	if where == "" {
+		return qc.filter
+	}
+	return fmt.Sprintf("( %s ) AND %s", where, qc.filter)
+}
+
 func (qc *PgQueryConverter) ConvertSelect(c *datastore.SimpleQuery, table string) string {
 	columns := "data"
 
 	if len(c.Colums) > 0 {
 		jsonQuery := []string{columns}
 		for _, col := range c.Colums {
-			jsonQuery = append(jsonQuery, fmt.Sprintf("%v as \"%v\"", qc.toField(col), col))
+			jsonQuery = append(jsonQuery, fmt.Sprintf("%v as %v", qc.toField(col), QuoteIdentifier(col)))
 		}
 		columns = strings.Join(jsonQuery, ", ")
 	}
@@ -151,108 +260,181 @@ func (qc *PgQueryConverter) ConvertASort(c *datastore.SortBy) string {
 	}
 }
 func (qc *PgQueryConverter) toJsonField(path string) string {
-	p := gabs.DotPathToSlice(path)
-	if len(p) > 1 {
-		last := p[len(p)-1] // Get the last element
-		leading := p[:len(p)-1]
-		path = fmt.Sprintf("->'%v'->'%v'", strings.Join(leading, "'->'"), last)
-	} else {
-		path = fmt.Sprintf("->'%v'", path)
-	}
-	return fmt.Sprintf("data%v", path)
+	return qc.toJsonPath(path, "->")
 }
 
 func (qc *PgQueryConverter) toField(path string) string {
-	p := gabs.DotPathToSlice(path)
-	if len(p) > 1 {
-		last := p[len(p)-1] // Get the last element
-		leading := p[:len(p)-1]
-		path = fmt.Sprintf("->'%v'->>'%v'", strings.Join(leading, "'->'"), last)
-	} else {
-		path = fmt.Sprintf("->>'%v'", path)
+	if expr, ok := qc.fields[path]; ok {
+		return expr
 	}
-	return fmt.Sprintf("data%v", path)
+	return qc.toJsonPath(path, "->>")
 }
+
 func (qc *PgQueryConverter) toFieldArr(path string) string {
+	return qc.toJsonPath(path, "->")
+}
+
+// toJsonPath builds the accessor for a dotted path into the data column. Every
+// segment is quoted as a literal and the last one uses the given operator.
+func (qc *PgQueryConverter) toJsonPath(path string, lastOp string) string {
 	p := gabs.DotPathToSlice(path)
-	if len(p) > 1 {
-		last := p[len(p)-1] // Get the last element
-		leading := p[:len(p)-1]
-		path = fmt.Sprintf("->'%v'->'%v'", strings.Join(leading, "'->'"), last)
-	} else {
-		path = fmt.Sprintf("->'%v'", path)
+	var sb strings.Builder
+	sb.WriteString("data")
+	for i, segment := range p {
+		if i == len(p)-1 {
+			sb.WriteString(lastOp)
+		} else {
+			sb.WriteString("->")
+		}
+		sb.WriteString(QuoteLiteral(segment))
+	}
+	return sb.String()
+}
+
+// asJsonb returns the JSON expression as JSONB, casting only when the data
+// column is JSON
+func (qc *PgQueryConverter) asJsonb(expr string) string {
+	if qc.jsonb {
+		return expr
+	}
+	return fmt.Sprintf("(%v)::jsonb", expr)
+}
+
+// arg adds a value to the argument list and returns its placeholder
+func (qc *PgQueryConverter) arg(v any) string {
+	qc.args = append(qc.args, v)
+	return fmt.Sprintf("$%d", len(qc.args))
+}
+
+// conditionArity is the number of Data entries (the field and the values) the
+// built in condition types need
+var conditionArity = map[string]int{
+	"eq": 2, "neq": 2, "between": 3, "lt": 2, "lte": 2, "gt": 2, "gte": 2,
+	"before": 1, "after": 1, "?": 2, "contains": 2, "includes": 1, "in": 2,
+	"anyin": 1, "null": 1,
+}
+
+// dateValue returns the date in the condition value. A SimpleQuery decoded
+// from JSON holds it as an RFC 3339 string.
+func dateValue(c *datastore.SimpleQueryCondition) (time.Time, bool) {
+	switch v := c.DataMap["value"].(type) {
+	case time.Time:
+		return v, !v.IsZero()
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// stringsValue returns the list of strings in the condition value. A
+// SimpleQuery decoded from JSON holds it as a []any.
+func stringsValue(c *datastore.SimpleQueryCondition) ([]string, bool) {
+	switch v := c.DataMap["value"].(type) {
+	case []string:
+		return v, true
+	case []any:
+		values := make([]string, len(v))
+		for i, s := range v {
+			str, ok := s.(string)
+			if !ok {
+				return nil, false
+			}
+			values[i] = str
+		}
+		return values, true
 	}
-	return fmt.Sprintf("data%v", path)
+	return nil, false
 }
 
 func (qc *PgQueryConverter) ConvertCondition(c *datastore.SimpleQueryCondition) string {
+	if n, ok := conditionArity[c.Type]; ok && len(c.Data) < n {
+		return qc.fail("%v condition needs %v values, got %v", c.Type, n, len(c.Data))
+	}
+
 	switch c.Type {
 	case "eq":
-		return fmt.Sprintf("(%v) = '%v'", qc.toField(c.Data[0]), c.Data[1])
+		return fmt.Sprintf("(%v) = %v", qc.toField(c.Data[0]), qc.arg(c.Data[1]))
 	case "neq":
-		return fmt.Sprintf("(%v) != '%v'", qc.toField(c.Data[0]), c.Data[1])
+		return fmt.Sprintf("(%v) != %v", qc.toField(c.Data[0]), qc.arg(c.Data[1]))
 	case "between":
-		return fmt.Sprintf("(%v)::numeric BETWEEN %v AND %v", qc.toField(c.Data[0]), c.Data[1], c.Data[2])
+		return fmt.Sprintf("(%v)::numeric BETWEEN %v AND %v", qc.toField(c.Data[0]), qc.arg(c.Data[1]), qc.arg(c.Data[2]))
 	case "lt":
-		return fmt.Sprintf("(%v)::numeric < %v", qc.toField(c.Data[0]), c.Data[1])
+		return fmt.Sprintf("(%v)::numeric < %v", qc.toField(c.Data[0]), qc.arg(c.Data[1]))
 	case "lte":
-		return fmt.Sprintf("(%v)::numeric  <= %v", qc.toField(c.Data[0]), c.Data[1])
+		return fmt.Sprintf("(%v)::numeric  <= %v", qc.toField(c.Data[0]), qc.arg(c.Data[1]))
 	case "gt":
-		return fmt.Sprintf("(%v)::numeric  > %v", qc.toField(c.Data[0]), c.Data[1])
+		return fmt.Sprintf("(%v)::numeric  > %v", qc.toField(c.Data[0]), qc.arg(c.Data[1]))
 	case "gte":
-		return fmt.Sprintf("(%v)::numeric  >= %v", qc.toField(c.Data[0]), c.Data[1])
+		return fmt.Sprintf("(%v)::numeric  >= %v", qc.toField(c.Data[0]), qc.arg(c.Data[1]))
 	case "before":
-		val := c.GetDate("value")
-		if !val.IsZero() {
+		if val, ok := dateValue(c); ok {
 			timestr := val.UTC().Format(time.RFC3339)
 			// return fmt.Sprintf("(data->'%v')::timestamptz < '%v'", c.Data[0], timestr)
 			// return fmt.Sprintf("to_date((%v), 'YYYY-MM-DDTHH24:MI:SS.MSZ') < '%v'", c.Data[0], timestr)
-			return fmt.Sprintf("(%v)::timestamptz < '%v'", qc.toField(c.Data[0]), timestr)
+			return fmt.Sprintf("(%v)::timestamptz < %v::timestamptz", qc.toField(c.Data[0]), qc.arg(timestr))
 		}
+		return qc.fail("before condition on %v needs a date value", c.Data[0])
 	case "after":
-		val := c.GetDate("value")
-		if !val.IsZero() {
+		if val, ok := dateValue(c); ok {
 			timestr := val.UTC().Format(time.RFC3339)
 			// return fmt.Sprintf("(data->'%v')::timestamptz > '%v'", c.Data[0], timestr)
 			// return fmt.Sprintf("to_date((%v), 'YYYY-MM-DDTHH24:MI:SS.MSZ') > '%v'", c.Data[0], timestr)
-			return fmt.Sprintf("(%v)::timestamptz > '%v'", qc.toField(c.Data[0]), timestr)
+			return fmt.Sprintf("(%v)::timestamptz > %v::timestamptz", qc.toField(c.Data[0]), qc.arg(timestr))
 		}
+		return qc.fail("after condition on %v needs a date value", c.Data[0])
 	case "?":
-		return fmt.Sprintf("(%v)::numeric  ? '%v'", qc.toField(c.Data[0]), c.Data[1])
+		return fmt.Sprintf("(%v)::numeric  ? %v", qc.toField(c.Data[0]), qc.arg(c.Data[1]))
 	case "contains":
-		return fmt.Sprintf("(%v)::jsonb @> '[\"%v\"]'", qc.toFieldArr(c.Data[0]), c.Data[1])
+		arr, _ := json.Marshal([]string{c.Data[1]})
+		return fmt.Sprintf("%v @> %v::jsonb", qc.asJsonb(qc.toFieldArr(c.Data[0])), qc.arg(string(arr)))
 	case "includes":
-		values := c.GetStringArr("value")
-		var xformed []string
-		for _, v := range values {
-			xformed = append(xformed, fmt.Sprintf("'%v'", v))
-		}
-		if values != nil {
-			return fmt.Sprintf("(%v) in (%v)", qc.toField(c.Data[0]), strings.Join(xformed, ","))
+		if values, ok := stringsValue(c); ok {
+			return fmt.Sprintf("(%v) = ANY(%v::text[])", qc.toField(c.Data[0]), qc.arg(values))
 		}
+		return qc.fail("includes condition on %v needs a list of values", c.Data[0])
 	case "in":
-		return fmt.Sprintf("(%v)::jsonb ? '%v'", qc.toJsonField(c.Data[0]), c.Data[1])
+		return fmt.Sprintf("%v ? %v", qc.asJsonb(qc.toJsonField(c.Data[0])), qc.arg(c.Data[1]))
 		// return "(data::jsonb->'users' ? 'test-user@example.com')"
 	case "anyin":
-		values := c.GetStringArr("value")
-		var xformed []string
-		for _, v := range values {
-			xformed = append(xformed, fmt.Sprintf("'%v'", v))
+		values, ok := stringsValue(c)
+		if !ok && c.DataMap["value"] != nil {
+			return qc.fail("anyin condition on %v needs a list of strings", c.Data[0])
 		}
-		vals := strings.Join(xformed, ",")
-		return fmt.Sprintf("(%v)::jsonb  ?| ARRAY[%v]", qc.toJsonField(c.Data[0]), vals)
+		if values == nil {
+			values = []string{}
+		}
+		return fmt.Sprintf("%v  ?| %v::text[]", qc.asJsonb(qc.toJsonField(c.Data[0])), qc.arg(values))
 	case "null":
 		return fmt.Sprintf("(%v) IS NULL", qc.toField(c.Data[0]))
-
+	case SearchConditionType:
+		return qc.convertSearch(c)
+	case LikeConditionType, ILikeConditionType, RegexConditionType, IRegexConditionType:
+		return qc.convertPattern(c)
+	case SimilarConditionType, WordSimilarConditionType:
+		return qc.convertSimilar(c)
 	}
-	return "UNKNOWN"
+	return qc.fail("unknown condition type %q", c.Type)
 }
 
+// ConvertConditionGroup joins the conditions and nested groups with the group
+// operator. Only "and", "or" and "not" (which negates the conditions joined with
+// AND) are accepted, any other operator is reported as an invalid query.
 func (qc *PgQueryConverter) ConvertConditionGroup(cg *datastore.SimpleQueryConditionGroup) string {
 	if len(cg.Conditions) == 0 && len(cg.Groups) == 0 {
 		return ""
 	}
 
+	var op string
+	switch strings.ToLower(cg.Operator) {
+	case "and", "", "not":
+		op = "and"
+	case "or":
+		op = "or"
+	default:
+		return qc.fail("unknown group operator %q", cg.Operator)
+	}
+
 	var conditionStr []string
 	for _, c := range cg.Conditions {
 		conditionStr = append(conditionStr, qc.ConvertCondition(c))
@@ -263,9 +445,45 @@ func (qc *PgQueryConverter) ConvertConditionGroup(cg *datastore.SimpleQueryCondi
 			conditionStr = append(conditionStr, "( "+result+" )")
 		}
 	}
-	return strings.Join(conditionStr, " "+cg.Operator+" ")
+	joined := strings.Join(conditionStr, " "+op+" ")
+	if strings.EqualFold(cg.Operator, "not") {
+		return "NOT ( " + joined + " )"
+	}
+	return joined
 }
 
 func (qc *PgQueryConverter) ToColumnName(name string) string {
 	return qc.toField(name)
 }
+
+var placeholderRegex = regexp.MustCompile(`\$(\d+)`)
+
+// inlineArgs replaces the $n placeholders in the sql with the quoted
+// arguments. The result is only meant for logging and debugging.
+func inlineArgs(sql string, args []any) string {
+	if len(args) == 0 {
+		return sql
+	}
+	return placeholderRegex.ReplaceAllStringFunc(sql, func(p string) string {
+		i, err := strconv.Atoi(p[1:])
+		if err != nil || i < 1 || i > len(args) {
+			return p
+		}
+		return debugLiteral(args[i-1])
+	})
+}
+
+func debugLiteral(v any) string {
+	switch val := v.(type) {
+	case []string:
+		quoted := make([]string, len(val))
+		for i, s := range val {
+			quoted[i] = debugLiteral(s)
+		}
+		return "ARRAY[" + strings.Join(quoted, ",") + "]"
+	case string:
+		return QuoteLiteral(val)
+	default:
+		return debugLiteral(fmt.Sprintf("%v", val))
+	}
+}
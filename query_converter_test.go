@@ -0,0 +1,117 @@
+package cloudypg
+
+import (
+	"testing"
+
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertWithArgs(t *testing.T) {
+	q := datastore.NewQuery()
+	q.Conditions.Equals("name", "O'Brien'; DROP TABLE testitems; --")
+	q.Conditions.Between("count", "1", "10")
+	q.Conditions.Includes("level1.value", []string{"a", "b"})
+
+	sql, args := new(PgQueryConverter).ConvertWithArgs(q, "testitems")
+	require.Equal(t, "SELECT data FROM testitems WHERE (data->>'name') = $1 and (data->>'count')::numeric BETWEEN $2 AND $3 and (data->'level1'->>'value') = ANY($4::text[])", sql)
+	require.Equal(t, []any{"O'Brien'; DROP TABLE testitems; --", "1", "10", []string{"a", "b"}}, args)
+}
+
+func TestConvertGroupOperators(t *testing.T) {
+	q := datastore.NewQuery()
+	q.Conditions.Equals("owner", "me")
+	or := q.Conditions.Or()
+	or.Equals("name", "a")
+	or.Equals("name", "b")
+	not := q.Conditions.Not()
+	not.Equals("status", "closed")
+	not.Equals("kind", "x")
+
+	qc := new(PgQueryConverter)
+	sql, _ := qc.ConvertWithArgs(q, "testitems")
+	require.NoError(t, qc.Err())
+	require.Equal(t, "SELECT data FROM testitems WHERE (data->>'owner') = $1 and ( (data->>'name') = $2 or (data->>'name') = $3 ) and ( NOT ( (data->>'status') = $4 and (data->>'kind') = $5 ) )", sql)
+
+	// An operator from the request can not rewrite the WHERE clause
+	q = datastore.NewQuery()
+	hostile := &datastore.SimpleQueryConditionGroup{Operator: "or 1=1 or"}
+	hostile.Equals("name", "a")
+	hostile.Equals("name", "b")
+	q.Conditions.Groups = append(q.Conditions.Groups, hostile)
+
+	qc = new(PgQueryConverter)
+	sql, _ = qc.ConvertWithArgs(q, "testitems")
+	require.ErrorIs(t, qc.Err(), ErrInvalidQuery)
+	require.NotContains(t, sql, "1=1")
+}
+
+func TestConvertDeleteWithArgs(t *testing.T) {
+	q := datastore.NewQuery()
+	q.Conditions.Equals("id", "1")
+	q.Recurse("id", "parent")
+
+	sql, args := new(PgQueryConverter).ConvertDeleteWithArgs(q, "testitems")
+	require.Contains(t, sql, "WHERE (data->>'id') = $1")
+	require.Equal(t, []any{"1"}, args)
+
+	q = datastore.NewQuery()
+	q.Conditions.Equals("id", "1")
+	sql, _ = new(PgQueryConverter).ConvertDeleteWithArgs(q, "testitems")
+	require.Equal(t, "DELETE FROM testitems WHERE (data->>'id') = $1 RETURNING id", sql)
+}
+
+func TestConvertInlinesForDebugging(t *testing.T) {
+	q := datastore.NewQuery()
+	q.Conditions.Equals("name", "it's")
+	q.Conditions.AnyIn("tags", []string{"x", "y"})
+
+	sql := new(PgQueryConverter).Convert(q, "testitems")
+	require.Equal(t, "SELECT data FROM testitems WHERE (data->>'name') = 'it''s' and (data->'tags')::jsonb  ?| ARRAY['x','y']::text[]", sql)
+}
+
+func TestConvertWithFilter(t *testing.T) {
+	q := datastore.NewQuery()
+	q.Conditions.Equals("name", "a")
+	qc := &PgQueryConverter{filter: notDeletedCondition}
+
+	sql, _ := qc.ConvertWithArgs(q, "testitems")
+	require.Equal(t, "SELECT data FROM testitems WHERE ( (data->>'name') = $1 ) AND deleted_at IS NULL", sql)
+
+	sql, args := qc.ConvertUpdateWithArgs(q, "testitems", "deleted_at = CURRENT_TIMESTAMP")
+	require.Equal(t, "UPDATE testitems SET deleted_at = CURRENT_TIMESTAMP WHERE ( (data->>'name') = $1 ) AND deleted_at IS NULL RETURNING id", sql)
+	require.Equal(t, []any{"a"}, args)
+
+	q.Recurse("id", "parent")
+	sql, _ = qc.ConvertUpdateWithArgs(q, "testitems", "deleted_at = CURRENT_TIMESTAMP")
+	require.Contains(t, sql, "SELECT t.id, t.data")
+	require.Contains(t, sql, "WHERE deleted_at IS NULL")
+	require.Contains(t, sql, "WHERE id IN (SELECT id FROM hierarchy)")
+}
+
+func TestConvertJsonb(t *testing.T) {
+	q := datastore.NewQuery()
+	q.Conditions.Contains("tags", "x")
+	q.Conditions.In("users", "a")
+
+	sql, _ := (&PgQueryConverter{jsonb: true}).ConvertWithArgs(q, "testitems")
+	require.Equal(t, "SELECT data FROM testitems WHERE data->'tags' @> $1::jsonb and data->'users' ? $2", sql)
+
+	sql, _ = new(PgQueryConverter).ConvertWithArgs(q, "testitems")
+	require.Equal(t, "SELECT data FROM testitems WHERE (data->'tags')::jsonb @> $1::jsonb and (data->'users')::jsonb ? $2", sql)
+}
+
+func TestConvertDecodedValues(t *testing.T) {
+	// Values as they look after the query is decoded from JSON
+	q := datastore.NewQuery()
+	q.Conditions.Conditions = append(q.Conditions.Conditions,
+		&datastore.SimpleQueryCondition{Type: "includes", Data: []string{"tags"}, DataMap: map[string]any{"value": []any{"a", "b"}}},
+		&datastore.SimpleQueryCondition{Type: "before", Data: []string{"created"}, DataMap: map[string]any{"value": "2024-01-02T03:04:05Z"}},
+	)
+
+	qc := new(PgQueryConverter)
+	sql, args := qc.ConvertWithArgs(q, "testitems")
+	require.NoError(t, qc.Err())
+	require.Equal(t, "SELECT data FROM testitems WHERE (data->>'tags') = ANY($1::text[]) and (data->>'created')::timestamptz < $2::timestamptz", sql)
+	require.Equal(t, []string{"a", "b"}, args[0])
+}
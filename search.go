@@ -0,0 +1,194 @@
+package cloudypg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// SearchConditionType is the SimpleQuery condition type for full text search,
+// added with SearchText
+const SearchConditionType = "search"
+
+// DefaultSearchLanguage is the text search configuration used when none is
+// given
+const DefaultSearchLanguage = "english"
+
+// SearchText adds a full text search condition on one or more string fields of
+// the document. The query uses the web search syntax (quoted phrases, "or" and
+// "-" to exclude) and the language names the PostgreSQL text search
+// configuration, DefaultSearchLanguage when empty. A GIN index declared with
+// Index.Search on the same fields and language is used by the condition.
+func SearchText(cg *datastore.SimpleQueryConditionGroup, query string, language string, fields ...string) {
+	c := &datastore.SimpleQueryCondition{Type: SearchConditionType}
+	c.Data = fields
+	c.Set("value", query)
+	c.Set("language", language)
+	cg.Conditions = append(cg.Conditions, c)
+}
+
+// TextSearch is the full text search run by Search
+type TextSearch struct {
+	Query    string
+	Language string
+	Fields   []string
+
+	// SortByRank orders the results by relevance before the query sort
+	SortByRank bool
+
+	// Headlines returns a snippet of each field with the matches highlighted
+	Headlines bool
+
+	// HeadlineOptions are passed to ts_headline, e.g. "MaxWords=20, MinWords=5"
+	HeadlineOptions string
+}
+
+// SearchResult is a document found by Search along with its relevance and the
+// highlighted snippets by field when they were asked for
+type SearchResult[T any] struct {
+	Key       string
+	Item      *T
+	Rank      float64
+	Headlines map[string]string
+}
+
+// searchConfig returns the text search configuration as a literal. It is not
+// sent as an argument so the expression matches a search index.
+func searchConfig(language string) string {
+	if language == "" {
+		language = DefaultSearchLanguage
+	}
+	return QuoteLiteral(language) + "::regconfig"
+}
+
+// toTsvector builds the document vector of the fields. The same expression is
+// used for conditions and indexes.
+func (qc *PgQueryConverter) toTsvector(language string, fields []string) string {
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = fmt.Sprintf("coalesce(%v, '')", qc.toField(f))
+	}
+	return fmt.Sprintf("to_tsvector(%v, %v)", searchConfig(language), strings.Join(parts, " || ' ' || "))
+}
+
+// toTsquery returns the query for the search text, adding it as an argument
+func (qc *PgQueryConverter) toTsquery(language string, query string) string {
+	return fmt.Sprintf("websearch_to_tsquery(%v, %v)", searchConfig(language), qc.arg(query))
+}
+
+func (qc *PgQueryConverter) convertSearch(c *datastore.SimpleQueryCondition) string {
+	if len(c.Data) == 0 {
+		return qc.fail("search condition needs at least one field")
+	}
+	query, _ := c.DataMap["value"].(string)
+	language, _ := c.DataMap["language"].(string)
+	return fmt.Sprintf("%v @@ %v", qc.toTsvector(language, c.Data), qc.toTsquery(language, query))
+}
+
+// ConvertSearchWithArgs converts the query and text search into a SELECT of
+// the id, data and rank of the matching rows, followed by a headline for each
+// search field when they are asked for
+func (qc *PgQueryConverter) ConvertSearchWithArgs(q *datastore.SimpleQuery, table string, search *TextSearch) (string, []any) {
+	qc.reset()
+
+	tsquery := qc.toTsquery(search.Language, search.Query)
+	tsvector := qc.toTsvector(search.Language, search.Fields)
+
+	columns := []string{"id", "data", fmt.Sprintf("ts_rank(%v, %v) AS rank", tsvector, tsquery)}
+	if search.Headlines {
+		opts := qc.arg(search.HeadlineOptions)
+		for _, f := range search.Fields {
+			columns = append(columns, fmt.Sprintf("ts_headline(%v, coalesce(%v, ''), %v, %v)",
+				searchConfig(search.Language), qc.toField(f), tsquery, opts))
+		}
+	}
+	sql := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), table)
+
+	where := []string{fmt.Sprintf("%v @@ %v", tsvector, tsquery)}
+	if cond := qc.convertWhere(q.Conditions); cond != "" {
+		where = append(where, "( "+cond+" )")
+	}
+	sql += " WHERE " + strings.Join(where, " AND ")
+
+	var sorts []string
+	if search.SortByRank {
+		sorts = append(sorts, "rank DESC")
+	}
+	if sort := qc.ConvertSort(q.SortBy); sort != "" {
+		sorts = append(sorts, sort)
+	}
+	if len(sorts) > 0 {
+		sql += " ORDER BY " + strings.Join(sorts, ", ")
+	}
+	if q.Size > 0 {
+		sql += fmt.Sprintf(" LIMIT %v", q.Size)
+	}
+	if q.Offset > 0 {
+		sql += fmt.Sprintf(" OFFSET %v", q.Offset)
+	}
+	return sql, qc.args
+}
+
+// Search runs a full text search along with the conditions, sort and paging of
+// the query, returning the relevance of each document and optionally the
+// highlighted snippets. Recursive queries are not supported.
+func (ds *JsonDataStore[T]) Search(ctx context.Context, query *datastore.SimpleQuery, search *TextSearch) ([]*SearchResult[T], error) {
+	if len(search.Fields) == 0 {
+		return nil, errors.New("a text search needs at least one field")
+	}
+	if query == nil {
+		query = datastore.NewQuery()
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	qc := ds.converter()
+	sql, args := qc.ConvertSearchWithArgs(query, ds.table, search)
+	if err := qc.Err(); err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, ds.wrapErr("search", "", err)
+	}
+	rtn, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*SearchResult[T], error) {
+		var jsonResult []byte
+		res := &SearchResult[T]{}
+		dest := []any{&res.Key, &jsonResult, &res.Rank}
+		var headlines []string
+		if search.Headlines {
+			headlines = make([]string, len(search.Fields))
+			for i := range headlines {
+				dest = append(dest, &headlines[i])
+			}
+		}
+		if err := row.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if search.Headlines {
+			res.Headlines = make(map[string]string, len(search.Fields))
+			for i, f := range search.Fields {
+				res.Headlines[f] = headlines[i]
+			}
+		}
+
+		item, err := fromByte[T](jsonResult)
+		if err != nil {
+			return nil, err
+		}
+		res.Item = item
+		return res, nil
+	})
+	if err != nil {
+		return nil, ds.wrapErr("search", "", err)
+	}
+	return rtn, nil
+}
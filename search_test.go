@@ -0,0 +1,103 @@
+package cloudypg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+type Article struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Tag   string `json:"tag"`
+}
+
+func TestSearchIndexMatchesCondition(t *testing.T) {
+	ctx := cloudy.StartContext()
+	ds := NewJsonDatastore[Article](ctx, nil, "articles")
+
+	name, def, err := ds.indexDefinition(Index{Fields: []string{"title", "body"}, Search: true})
+	require.NoError(t, err)
+	require.Equal(t, "articles_title_body_fts", name)
+	require.Equal(t, "USING gin ((to_tsvector('english'::regconfig, coalesce(data->>'title', '') || ' ' || coalesce(data->>'body', ''))))", def)
+
+	q := datastore.NewQuery()
+	SearchText(q.Conditions, "postgres -mysql", "", "title", "body")
+	sql, args := ds.converter().ConvertWithArgs(q, ds.table)
+	require.Equal(t, `SELECT data FROM "articles" WHERE to_tsvector('english'::regconfig, coalesce(data->>'title', '') || ' ' || coalesce(data->>'body', '')) @@ websearch_to_tsquery('english'::regconfig, $1)`, sql)
+	require.Equal(t, []any{"postgres -mysql"}, args)
+
+	_, _, err = ds.indexDefinition(Index{Search: true})
+	require.Error(t, err)
+
+	q = datastore.NewQuery()
+	SearchText(q.Conditions, "postgres", "")
+	qc := ds.converter()
+	sql, _ = qc.ConvertWithArgs(q, ds.table)
+	require.ErrorIs(t, qc.Err(), ErrInvalidQuery)
+	require.NotContains(t, sql, "@@")
+}
+
+func TestConvertSearchWithArgs(t *testing.T) {
+	q := datastore.NewQuery()
+	q.Conditions.Equals("tag", "db")
+	q.Size = 10
+
+	sql, args := new(PgQueryConverter).ConvertSearchWithArgs(q, "articles", &TextSearch{
+		Query:      "index",
+		Language:   "simple",
+		Fields:     []string{"title"},
+		SortByRank: true,
+		Headlines:  true,
+	})
+	require.True(t, strings.HasPrefix(sql, "SELECT id, data, ts_rank(to_tsvector('simple'::regconfig, coalesce(data->>'title', '')), websearch_to_tsquery('simple'::regconfig, $1)) AS rank, ts_headline("))
+	require.True(t, strings.HasSuffix(sql, "AND ( (data->>'tag') = $3 ) ORDER BY rank DESC LIMIT 10"))
+	require.Equal(t, []any{"index", "", "db"}, args)
+}
+
+func TestJsonDatastoreSearch(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[Article](ctx, p, "articles",
+		WithIndexes(Index{Fields: []string{"title", "body"}, Search: true}))
+	require.NoError(t, ds.Open(ctx, nil))
+
+	articles := []*Article{
+		{ID: "1", Title: "Indexing JSON in Postgres", Body: "GIN indexes make containment queries fast", Tag: "db"},
+		{ID: "2", Title: "Cooking pasta", Body: "Boil the water before adding salt", Tag: "food"},
+		{ID: "3", Title: "Postgres full text search", Body: "Search documents and rank the results in postgres", Tag: "db"},
+	}
+	for _, a := range articles {
+		require.NoError(t, ds.Save(ctx, a, a.ID))
+	}
+
+	t.Run("Condition", func(t *testing.T) {
+		q := datastore.NewQuery()
+		SearchText(q.Conditions, "postgres", "", "title", "body")
+		found, err := ds.Query(ctx, q)
+		require.NoError(t, err)
+		require.Len(t, found, 2)
+	})
+
+	t.Run("Rank And Headlines", func(t *testing.T) {
+		results, err := ds.Search(ctx, nil, &TextSearch{
+			Query:      "postgres search",
+			Fields:     []string{"title", "body"},
+			SortByRank: true,
+			Headlines:  true,
+		})
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		require.Equal(t, "3", results[0].Key)
+		require.Greater(t, results[0].Rank, 0.0)
+		require.Contains(t, results[0].Headlines["title"], "<b>Search</b>")
+	})
+}
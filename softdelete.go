@@ -0,0 +1,134 @@
+package cloudypg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const notDeletedCondition = "deleted_at IS NULL"
+
+// WithSoftDelete makes Delete, DeleteAll and DeleteQuery mark documents with a
+// deleted_at timestamp instead of removing them. Marked documents are hidden
+// from every read until they are brought back with Restore or saved again, and
+// Purge removes them for good.
+func WithSoftDelete() JsonDataStoreOption {
+	return func(opts *jsonDataStoreOptions) {
+		opts.softDelete = true
+	}
+}
+
+// converter returns a query converter that hides the rows this datastore
+// should not return
+func (ds *JsonDataStore[T]) converter() *PgQueryConverter {
+	return &PgQueryConverter{jsonb: ds.jsonb.Load(), filter: ds.visibleCondition("")}
+}
+
+// visibleCondition returns the condition matching the rows the datastore
+// returns, leaving out soft deleted and expired documents. The columns are
+// prefixed with the alias when one is given. An empty string is returned when
+// neither soft delete nor expiry is on.
+func (ds *JsonDataStore[T]) visibleCondition(alias string) string {
+	if alias != "" {
+		alias += "."
+	}
+	var conds []string
+	if ds.opts.softDelete {
+		conds = append(conds, alias+notDeletedCondition)
+	}
+	if ds.opts.expiry {
+		conds = append(conds, fmt.Sprintf(notExpiredCondition, alias, alias))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// andVisible returns the visible condition to add to an existing WHERE clause,
+// or an empty string when there is none
+func (ds *JsonDataStore[T]) andVisible() string {
+	if cond := ds.visibleCondition(""); cond != "" {
+		return " AND " + cond
+	}
+	return ""
+}
+
+// whereVisible returns the visible WHERE clause for a statement that has no
+// other conditions, or an empty string when there is none
+func (ds *JsonDataStore[T]) whereVisible() string {
+	if cond := ds.visibleCondition(""); cond != "" {
+		return " WHERE " + cond
+	}
+	return ""
+}
+
+// reviveSet returns the assignments that bring back a soft deleted or expired
+// document when it is written again
+func (ds *JsonDataStore[T]) reviveSet() string {
+	set := ""
+	if ds.opts.softDelete {
+		set += ", deleted_at = NULL"
+	}
+	if ds.opts.expiry {
+		set += ", expires_at = NULL"
+	}
+	return set
+}
+
+// Restore brings back soft deleted documents and returns the keys that were
+// restored. Keys that are not deleted are ignored.
+func (ds *JsonDataStore[T]) Restore(ctx context.Context, key ...string) ([]string, error) {
+	if !ds.opts.softDelete {
+		return nil, fmt.Errorf("soft delete is not enabled for %v", ds.table)
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	sqlRestore := fmt.Sprintf(`UPDATE %v SET deleted_at = NULL, last_updated = CURRENT_TIMESTAMP
+		WHERE id = ANY($1) AND deleted_at IS NOT NULL
+		RETURNING id`, ds.table)
+	rows, err := conn.Query(ctx, sqlRestore, key)
+	if err != nil {
+		return nil, ds.wrapErr("restore", "", err)
+	}
+	defer rows.Close()
+
+	var restored []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return restored, ds.wrapErr("restore", "", err)
+		}
+		restored = append(restored, id)
+	}
+	if err := rows.Err(); err != nil {
+		return restored, ds.wrapErr("restore", "", err)
+	}
+	return restored, nil
+}
+
+// Purge permanently removes documents that were soft deleted more than
+// olderThan ago and returns the number of documents removed. A zero duration
+// purges every soft deleted document.
+func (ds *JsonDataStore[T]) Purge(ctx context.Context, olderThan time.Duration) (int64, error) {
+	if !ds.opts.softDelete {
+		return 0, fmt.Errorf("soft delete is not enabled for %v", ds.table)
+	}
+
+	conn, err := ds.checkConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer ds.returnConnection(ctx, conn)
+
+	sqlPurge := fmt.Sprintf(`DELETE FROM %v
+		WHERE deleted_at IS NOT NULL AND deleted_at <= CURRENT_TIMESTAMP - make_interval(secs => $1)`, ds.table)
+	tag, err := conn.Exec(ctx, sqlPurge, olderThan.Seconds())
+	if err != nil {
+		return 0, ds.wrapErr("purge", "", err)
+	}
+	return tag.RowsAffected(), nil
+}
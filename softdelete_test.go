@@ -0,0 +1,98 @@
+package cloudypg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJsonDatastoreSoftDelete(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems", WithSoftDelete())
+	require.NoError(t, ds.Open(ctx, nil))
+
+	root := &TestItem{ID: "1", Name: "Root"}
+	child := &TestItem{ID: "2", Name: "Child", Parent: "1"}
+	other := &TestItem{ID: "3", Name: "Other"}
+	for _, item := range []*TestItem{root, child, other} {
+		require.NoError(t, ds.Save(ctx, item, item.ID))
+	}
+
+	require.NoError(t, ds.Delete(ctx, other.ID))
+
+	item, err := ds.Get(ctx, other.ID)
+	require.NoError(t, err)
+	require.Nil(t, item)
+
+	exists, err := ds.Exists(ctx, other.ID)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	all, err := ds.GetAll(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+
+	cnt, err := ds.Count(ctx, datastore.NewQuery())
+	require.NoError(t, err)
+	require.Equal(t, 2, cnt)
+
+	// The row is still in the table
+	raw := NewJsonDatastore[TestItem](ctx, p, "testitems")
+	exists, err = raw.Exists(ctx, other.ID)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	restored, err := ds.Restore(ctx, other.ID, "missing")
+	require.NoError(t, err)
+	require.Equal(t, []string{other.ID}, restored)
+
+	exists, err = ds.Exists(ctx, other.ID)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	t.Run("Recursive", func(t *testing.T) {
+		q := datastore.NewQuery()
+		q.Conditions.Equals("id", root.ID)
+		q.Recurse("id", "parent")
+		ids, err := ds.DeleteQuery(ctx, q)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{root.ID, child.ID}, ids)
+
+		all, err := ds.GetAll(ctx)
+		require.NoError(t, err)
+		require.Len(t, all, 1)
+		require.Equal(t, other.ID, all[0].ID)
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		// The cutoff does not move with the session time zone
+		conn, err := p.Acquire(ctx)
+		require.NoError(t, err)
+		var dataType string
+		err = conn.QueryRow(ctx, `SELECT data_type FROM information_schema.columns
+			WHERE table_name = 'testitems' AND column_name = 'deleted_at'`).Scan(&dataType)
+		p.Return(ctx, conn)
+		require.NoError(t, err)
+		require.Equal(t, "timestamp with time zone", dataType)
+
+		purged, err := ds.Purge(ctx, time.Hour)
+		require.NoError(t, err)
+		require.Zero(t, purged)
+
+		purged, err = ds.Purge(ctx, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), purged)
+
+		all, err := raw.GetAll(ctx)
+		require.NoError(t, err)
+		require.Len(t, all, 1)
+	})
+}
@@ -0,0 +1,98 @@
+package cloudypg
+
+import (
+	"context"
+	"fmt"
+	"iter"
+
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// StreamAll returns an iterator over every item in the store. Unlike GetAll the
+// rows are decoded one at a time as the loop asks for them, so memory use does
+// not grow with the size of the table. A connection is held until the loop
+// finishes. Breaking out of the loop closes the result set and returns the
+// connection, and cancelling the context stops the query with the context error
+// as the final value. Inside RunInTx the loop holds the transaction's connection,
+// so other store calls made in the loop fail with "conn busy".
+func (ds *JsonDataStore[T]) StreamAll(ctx context.Context) iter.Seq2[*T, error] {
+	sql := fmt.Sprintf(`SELECT data FROM %v%v`, ds.table, ds.whereVisible())
+	return streamRows(ctx, ds, sql, nil, nil, scanItem[T])
+}
+
+// StreamQuery is the streaming version of Query. See StreamAll for how the
+// connection and result set are managed.
+func (ds *JsonDataStore[T]) StreamQuery(ctx context.Context, query *datastore.SimpleQuery) iter.Seq2[*T, error] {
+	qc := ds.converter()
+	sql, args := qc.ConvertWithArgs(query, ds.table)
+	return streamRows(ctx, ds, sql, args, qc.Err(), scanItem[T])
+}
+
+// StreamQueryAsMap is the streaming version of QueryAsMap
+func (ds *JsonDataStore[T]) StreamQueryAsMap(ctx context.Context, query *datastore.SimpleQuery) iter.Seq2[map[string]any, error] {
+	qc := ds.converter()
+	sql, args := qc.ConvertWithArgs(query, ds.table)
+	return streamRows(ctx, ds, sql, args, qc.Err(), func(rows pgx.Rows) (map[string]any, error) {
+		return pgx.RowToMap(rows)
+	})
+}
+
+// StreamQueryTable is the streaming version of QueryTable
+func (ds *JsonDataStore[T]) StreamQueryTable(ctx context.Context, query *datastore.SimpleQuery) iter.Seq2[[]any, error] {
+	qc := ds.converter()
+	sql, args := qc.ConvertWithArgs(query, ds.table)
+	return streamRows(ctx, ds, sql, args, qc.Err(), func(rows pgx.Rows) ([]any, error) {
+		return rows.Values()
+	})
+}
+
+func scanItem[T any](rows pgx.Rows) (*T, error) {
+	var jsonResult []byte
+	err := rows.Scan(&jsonResult)
+	if err != nil {
+		return nil, fmt.Errorf("error scaning into struct : %v", err)
+	}
+	return fromByte[T](jsonResult)
+}
+
+// streamRows runs the query when the iterator is started and yields each
+// scanned row. The first error ends the iteration, and a conversion error is
+// yielded without running the query.
+func streamRows[T any, R any](ctx context.Context, ds *JsonDataStore[T], sql string, args []any, convertErr error, scan func(rows pgx.Rows) (R, error)) iter.Seq2[R, error] {
+	return func(yield func(R, error) bool) {
+		var zero R
+		if convertErr != nil {
+			yield(zero, convertErr)
+			return
+		}
+
+		conn, err := ds.checkConnection(ctx)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		defer ds.returnConnection(ctx, conn)
+
+		rows, err := conn.Query(ctx, sql, args...)
+		if err != nil {
+			yield(zero, ds.wrapErr("stream", "", err))
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			v, err := scan(rows)
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+			if !yield(v, nil) {
+				return
+			}
+		}
+		if err = rows.Err(); err != nil {
+			yield(zero, ds.wrapErr("stream", "", err))
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package cloudypg
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJsonDatastoreStream(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	ds := NewJsonDatastore[TestItem](ctx, p, "testitems")
+	require.NoError(t, ds.Open(ctx, nil))
+
+	for i := 0; i < 20; i++ {
+		item := &TestItem{ID: fmt.Sprintf("item-%02d", i), Name: fmt.Sprintf("name-%v", i%2)}
+		require.NoError(t, ds.Save(ctx, item, item.ID))
+	}
+
+	t.Run("All", func(t *testing.T) {
+		cnt := 0
+		for item, err := range ds.StreamAll(ctx) {
+			require.NoError(t, err)
+			require.NotNil(t, item)
+			cnt++
+		}
+		require.Equal(t, 20, cnt)
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		q := datastore.NewQuery()
+		q.Conditions.Equals("name", "name-1")
+		cnt := 0
+		for item, err := range ds.StreamQuery(ctx, q) {
+			require.NoError(t, err)
+			require.Equal(t, "name-1", item.Name)
+			cnt++
+		}
+		require.Equal(t, 10, cnt)
+	})
+
+	t.Run("Early Break", func(t *testing.T) {
+		// Breaking repeatedly must return the connection every time
+		for i := 0; i < 20; i++ {
+			for _, err := range ds.StreamAll(ctx) {
+				require.NoError(t, err)
+				break
+			}
+		}
+		exists, err := ds.Exists(ctx, "item-00")
+		require.NoError(t, err)
+		require.True(t, exists)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		var lastErr error
+		for _, err := range ds.StreamAll(cctx) {
+			lastErr = err
+		}
+		require.ErrorContains(t, lastErr, context.Canceled.Error())
+	})
+
+	t.Run("Table", func(t *testing.T) {
+		q := datastore.NewQuery()
+		q.Colums = []string{"id", "name"}
+		q.Conditions.Equals("id", "item-01")
+		for row, err := range ds.StreamQueryTable(ctx, q) {
+			require.NoError(t, err)
+			require.Equal(t, "item-01", row[1])
+		}
+		for row, err := range ds.StreamQueryAsMap(ctx, q) {
+			require.NoError(t, err)
+			require.Equal(t, "name-1", row["name"])
+		}
+	})
+}
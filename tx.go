@@ -0,0 +1,118 @@
+package cloudypg
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// dbConn is what the datastore runs its statements on. It is either a pooled
+// connection or the transaction placed in the context by RunInTx, and Begin
+// starts a transaction or a savepoint respectively.
+type dbConn interface {
+	querier
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+type txContextKey struct{}
+
+// pgTx is a transaction carried in the context. Transactions opened on other
+// providers are kept in the chain so each store finds its own.
+type pgTx struct {
+	tx       pgx.Tx
+	provider PostgresqlConnectionProvider
+	parent   *pgTx
+}
+
+// TxOption configures the transaction started by RunInTx
+type TxOption func(opts *pgx.TxOptions)
+
+// WithIsolation sets the isolation level of the transaction
+func WithIsolation(level pgx.TxIsoLevel) TxOption {
+	return func(opts *pgx.TxOptions) {
+		opts.IsoLevel = level
+	}
+}
+
+// ReadOnly starts a read only transaction
+func ReadOnly() TxOption {
+	return func(opts *pgx.TxOptions) {
+		opts.AccessMode = pgx.ReadOnly
+	}
+}
+
+// Deferrable makes a serializable read only transaction deferrable
+func Deferrable() TxOption {
+	return func(opts *pgx.TxOptions) {
+		opts.DeferrableMode = pgx.Deferrable
+	}
+}
+
+// withTx returns a context carrying the transaction for the provider
+func withTx(ctx context.Context, provider PostgresqlConnectionProvider, tx pgx.Tx) context.Context {
+	parent, _ := ctx.Value(txContextKey{}).(*pgTx)
+	return context.WithValue(ctx, txContextKey{}, &pgTx{tx: tx, provider: provider, parent: parent})
+}
+
+// txFromContext returns the innermost transaction opened on the provider, or
+// nil when there is none
+func txFromContext(ctx context.Context, provider PostgresqlConnectionProvider) pgx.Tx {
+	cur, _ := ctx.Value(txContextKey{}).(*pgTx)
+	for ; cur != nil; cur = cur.parent {
+		if cur.provider == provider {
+			return cur.tx
+		}
+	}
+	return nil
+}
+
+// RunInTx runs fn in a transaction on a connection from the provider. The
+// transaction is carried in the context passed to fn, and every JsonDataStore
+// using the same provider runs its statements in it, as does a KeyValueStore
+// created with WithTxProvider for the provider and bound with WithContext. The
+// transaction is committed when fn returns nil and rolled back when it returns
+// an error or panics. The error from fn is returned as it is.
+//
+// A call nested inside another transaction on the same provider runs in a
+// savepoint, so its failure only undoes its own work. The options only apply
+// to the outermost transaction.
+//
+// Every statement shares the one connection of the transaction, so while a
+// StreamAll or StreamQuery loop is reading its rows no other statement can run
+// in the transaction. Calling another store method inside the loop fails with
+// "conn busy"; collect the rows first or use Query.
+func RunInTx(ctx context.Context, provider PostgresqlConnectionProvider, fn func(ctx context.Context) error, opts ...TxOption) error {
+	if provider == nil {
+		return errors.New("no connection provider")
+	}
+
+	var fnErr error
+	run := func(tx pgx.Tx) error {
+		fnErr = fn(withTx(ctx, provider, tx))
+		return fnErr
+	}
+
+	var err error
+	if tx := txFromContext(ctx, provider); tx != nil {
+		err = pgx.BeginFunc(ctx, tx, run)
+	} else {
+		var txOpts pgx.TxOptions
+		for _, opt := range opts {
+			opt(&txOpts)
+		}
+
+		conn, cerr := provider.Acquire(ctx)
+		if cerr != nil {
+			return connectionError("", cerr)
+		}
+		defer provider.Return(ctx, conn)
+
+		err = pgx.BeginTxFunc(ctx, conn, txOpts, run)
+	}
+
+	if err != nil && err == fnErr {
+		return err
+	}
+	return newError("transaction", "", "", err)
+}
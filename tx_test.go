@@ -0,0 +1,158 @@
+package cloudypg
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunInTx(t *testing.T) {
+	ctx := cloudy.StartContext()
+	cfg := CreateDefaultPostgresqlContainer(t)
+
+	connStr := ConnStringFrom(ctx, cfg)
+
+	p := NewDedicatedPostgreSQLConnectionProvider(connStr)
+	items := NewJsonDatastore[TestItem](ctx, p, "testitems")
+	require.NoError(t, items.Open(ctx, nil))
+	others := NewJsonDatastore[TestItem](ctx, p, "otheritems")
+	require.NoError(t, others.Open(ctx, nil))
+
+	conn, err := Connect(ctx, cfg)
+	require.NoError(t, err)
+	kv, err := NewKeyValueStore(ctx, "txkeyvalues", conn, WithTxProvider(p))
+	require.NoError(t, err)
+
+	t.Run("Commit", func(t *testing.T) {
+		err := RunInTx(ctx, p, func(ctx context.Context) error {
+			if err := items.Save(ctx, &TestItem{ID: "1", Name: "One"}, "1"); err != nil {
+				return err
+			}
+			if err := others.Save(ctx, &TestItem{ID: "1", Name: "Other"}, "1"); err != nil {
+				return err
+			}
+			return kv.WithContext(ctx).Set("one", "1")
+		})
+		require.NoError(t, err)
+
+		exists, err := others.Exists(ctx, "1")
+		require.NoError(t, err)
+		require.True(t, exists)
+
+		value, err := kv.Get("one")
+		require.NoError(t, err)
+		require.Equal(t, "1", value)
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		failed := errors.New("failed")
+		err := RunInTx(ctx, p, func(ctx context.Context) error {
+			if err := items.Save(ctx, &TestItem{ID: "2", Name: "Two"}, "2"); err != nil {
+				return err
+			}
+			if err := others.Save(ctx, &TestItem{ID: "2", Name: "Two"}, "2"); err != nil {
+				return err
+			}
+			return failed
+		})
+		require.ErrorIs(t, err, failed)
+
+		for _, ds := range []*JsonDataStore[TestItem]{items, others} {
+			exists, err := ds.Exists(ctx, "2")
+			require.NoError(t, err)
+			require.False(t, exists)
+		}
+	})
+
+	t.Run("Nested", func(t *testing.T) {
+		err := RunInTx(ctx, p, func(ctx context.Context) error {
+			if err := items.Save(ctx, &TestItem{ID: "3", Name: "Outer"}, "3"); err != nil {
+				return err
+			}
+
+			// The failed savepoint only undoes its own writes
+			inner := RunInTx(ctx, p, func(ctx context.Context) error {
+				if err := items.Save(ctx, &TestItem{ID: "4", Name: "Inner"}, "4"); err != nil {
+					return err
+				}
+				return errors.New("inner failed")
+			})
+			require.Error(t, inner)
+			return nil
+		})
+		require.NoError(t, err)
+
+		exists, err := items.Exists(ctx, "3")
+		require.NoError(t, err)
+		require.True(t, exists)
+		exists, err = items.Exists(ctx, "4")
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+
+	t.Run("Read Only", func(t *testing.T) {
+		err := RunInTx(ctx, p, func(ctx context.Context) error {
+			return items.Save(ctx, &TestItem{ID: "5", Name: "Five"}, "5")
+		}, ReadOnly(), WithIsolation(pgx.Serializable))
+		require.Error(t, err)
+	})
+
+	t.Run("Query And Update", func(t *testing.T) {
+		q := datastore.NewQuery()
+		q.Conditions.Equals("id", "1")
+		_, err := items.QueryAndUpdate(ctx, q, func(ctx context.Context, found []*TestItem) ([]*TestItem, error) {
+			for _, item := range found {
+				item.Name = "Updated"
+				if err := items.Save(ctx, item, item.ID); err != nil {
+					return nil, err
+				}
+			}
+			return found, nil
+		})
+		require.NoError(t, err)
+
+		stored, err := items.Get(ctx, "1")
+		require.NoError(t, err)
+		require.Equal(t, "Updated", stored.Name)
+	})
+
+	t.Run("Other Provider", func(t *testing.T) {
+		// A store bound to another provider stays out of the transaction
+		other := NewDedicatedPostgreSQLConnectionProvider(connStr)
+		conn, err := Connect(ctx, cfg)
+		require.NoError(t, err)
+		outside, err := NewKeyValueStore(ctx, "txkeyvalues", conn, WithTxProvider(other))
+		require.NoError(t, err)
+
+		failed := errors.New("failed")
+		err = RunInTx(ctx, p, func(ctx context.Context) error {
+			if err := outside.WithContext(ctx).Set("outside", "1"); err != nil {
+				return err
+			}
+			return kv.WithContext(ctx).Set("inside", "1")
+		})
+		require.NoError(t, err)
+		err = RunInTx(ctx, p, func(ctx context.Context) error {
+			if err := outside.WithContext(ctx).Set("outside", "2"); err != nil {
+				return err
+			}
+			if err := kv.WithContext(ctx).Set("inside", "2"); err != nil {
+				return err
+			}
+			return failed
+		})
+		require.ErrorIs(t, err, failed)
+
+		value, err := kv.Get("outside")
+		require.NoError(t, err)
+		require.Equal(t, "2", value)
+		value, err = kv.Get("inside")
+		require.NoError(t, err)
+		require.Equal(t, "1", value)
+	})
+}